@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/tdewolff/minify/v2"
+	"github.com/tdewolff/minify/v2/css"
+	"github.com/tdewolff/minify/v2/js"
+	"github.com/tdewolff/minify/v2/json"
+	"github.com/tdewolff/minify/v2/svg"
+)
+
+// assetMediaTypes maps the extensions of assets which may be minified to
+// their media types.
+var assetMediaTypes = map[string]string{
+	".css":  "text/css",
+	".js":   "application/javascript",
+	".mjs":  "application/javascript",
+	".svg":  "image/svg+xml",
+	".json": "application/json",
+}
+
+// assetMinify minifies copied assets. It is separate from defaultMinify so
+// that the CSS and JS embedded in rendered HTML are left alone.
+var assetMinify = newAssetMinifier()
+
+func newAssetMinifier() *minify.M {
+	m := minify.New()
+	m.AddFunc("text/css", css.Minify)
+	m.AddFunc("application/javascript", js.Minify)
+	m.AddFunc("image/svg+xml", svg.Minify)
+	m.AddFunc("application/json", json.Minify)
+	return m
+}
+
+func checkMinifyTypes(types []string) error {
+	supported := make(map[string]struct{})
+	for _, typ := range assetMediaTypes {
+		supported[typ] = struct{}{}
+	}
+	for _, typ := range types {
+		if _, ok := supported[typ]; !ok {
+			return fmt.Errorf("cannot minify media type %q", typ)
+		}
+	}
+	return nil
+}
+
+// minifyType returns the media type to use for minifying the asset named
+// name, or the empty string if it should be copied as-is. Assets are never
+// minified in dev mode.
+func (s *sitkin) minifyType(name string) string {
+	if s.devMode {
+		return ""
+	}
+	typ, ok := assetMediaTypes[path.Ext(name)]
+	if !ok {
+		return ""
+	}
+	for _, t := range s.config.Minify {
+		if t == typ {
+			return typ
+		}
+	}
+	return ""
+}
+
+// A bundle is a single asset made by concatenating several source files.
+type bundle struct {
+	name     string // URL path, as given in config.json
+	srcPaths []string
+	dstPath  string // relative to dst dir
+	minify   string // media type, if the output is minified
+	contents []byte
+}
+
+func (s *sitkin) loadBundles() error {
+	var names []string
+	for name := range s.config.Bundles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		b, err := s.loadBundle(name, s.config.Bundles[name])
+		if err != nil {
+			return fmt.Errorf("error loading bundle %s: %s", name, err)
+		}
+		s.bundles = append(s.bundles, b)
+		s.hashAssets[name] = "/" + filepath.ToSlash(b.dstPath)
+	}
+	return nil
+}
+
+func (s *sitkin) loadBundle(name string, srcPaths []string) (*bundle, error) {
+	if !strings.HasPrefix(name, "/") {
+		return nil, fmt.Errorf("bundle name must begin with /")
+	}
+	if len(srcPaths) == 0 {
+		return nil, fmt.Errorf("bundle has no files")
+	}
+	relpath := filepath.FromSlash(strings.TrimPrefix(name, "/"))
+	b := &bundle{
+		name:     name,
+		srcPaths: srcPaths,
+		minify:   s.minifyType(relpath),
+	}
+	var buf bytes.Buffer
+	for _, src := range srcPaths {
+		contents, err := os.ReadFile(filepath.Join(s.dir, filepath.FromSlash(src)))
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(contents)
+		if len(contents) > 0 && contents[len(contents)-1] != '\n' {
+			buf.WriteByte('\n')
+		}
+	}
+	b.contents = buf.Bytes()
+
+	h := "NOHASH"
+	if !s.devMode {
+		sum := sha256.Sum256(b.contents)
+		h = base62Hash(sum[:8])
+	}
+	ext := path.Ext(relpath)
+	b.dstPath = strings.TrimSuffix(relpath, ext) + "." + h + ext
+	return b, nil
+}
+
+func (b *bundle) write(dstDir string) error {
+	return writeFileAtomic(filepath.Join(dstDir, b.dstPath), 0o644, func(w io.Writer) error {
+		if b.minify != "" {
+			return assetMinify.Minify(b.minify, w, bytes.NewReader(b.contents))
+		}
+		_, err := w.Write(b.contents)
+		return err
+	})
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"strconv"
+	"time"
+)
+
+// cacheFormat is incremented whenever the cache contents change meaning.
+const cacheFormat = 1
+
+const cacheDirName = ".sitkin-cache"
+
+// A buildCache persists expensive build results (asset hashes and rendered
+// markdown) across runs. The whole cache is discarded if the sitkin version
+// or the project config changes.
+//
+// A nil *buildCache is valid and caches nothing.
+type buildCache struct {
+	dir        string // project dir
+	verbose    bool
+	keepAssets bool      // keep the old asset entries (dev builds don't hash assets)
+	old        cacheData // loaded from disk
+	cur        cacheData // used by this build; saved to disk
+}
+
+type cacheData struct {
+	Version    string
+	ConfigHash string
+	Assets     map[string]cachedAsset // keyed by path relative to the project dir
+	Markdown   map[string]string      // keyed by hash of the markdown
+}
+
+type cachedAsset struct {
+	Size     int64
+	ModTime  time.Time
+	Checksum uint64 // see fileChecksum
+	Hash     string
+}
+
+func newCacheData(configHash string) cacheData {
+	return cacheData{
+		Version:    sitkinVersion(),
+		ConfigHash: configHash,
+		Assets:     make(map[string]cachedAsset),
+		Markdown:   make(map[string]string),
+	}
+}
+
+// loadBuildCache loads the cache of the project in dir. The cache of a dev
+// build keeps the asset hashes from previous builds, since dev builds don't
+// use them.
+func loadBuildCache(dir string, configJSON []byte, devMode, verbose bool) *buildCache {
+	h := sha256.Sum256(configJSON)
+	configHash := base62Hash(h[:8])
+	c := &buildCache{
+		dir:        dir,
+		verbose:    verbose,
+		keepAssets: devMode,
+		old:        newCacheData(configHash),
+		cur:        newCacheData(configHash),
+	}
+	b, err := os.ReadFile(c.path())
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Println("Warning: cannot read build cache:", err)
+		}
+		return c
+	}
+	var old cacheData
+	if err := json.Unmarshal(b, &old); err != nil {
+		log.Println("Warning: ignoring corrupt build cache:", err)
+		return c
+	}
+	if old.Version != c.cur.Version || old.ConfigHash != c.cur.ConfigHash {
+		if verbose {
+			log.Println("Discarding stale build cache")
+		}
+		return c
+	}
+	if old.Assets != nil {
+		c.old.Assets = old.Assets
+	}
+	if old.Markdown != nil {
+		c.old.Markdown = old.Markdown
+	}
+	return c
+}
+
+func (c *buildCache) path() string {
+	return filepath.Join(c.dir, cacheDirName, "cache.json")
+}
+
+// save writes out the entries used by the current build (and, if
+// c.keepAssets is set, the old asset entries).
+func (c *buildCache) save() error {
+	if c == nil {
+		return nil
+	}
+	if c.keepAssets {
+		for key, a := range c.old.Assets {
+			if _, ok := c.cur.Assets[key]; !ok {
+				c.cur.Assets[key] = a
+			}
+		}
+	}
+	b, err := json.Marshal(c.cur)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(c.path(), 0o644, func(w io.Writer) error {
+		_, err := w.Write(b)
+		return err
+	})
+}
+
+// fileHash is like the fileHash function, but it reuses the hash from a
+// previous build if the file's size and modification time are unchanged.
+// Otherwise (as in a fresh checkout, which resets the modification times) it
+// reuses the hash if the file's size and checksum are unchanged.
+func (c *buildCache) fileHash(name string) (string, error) {
+	if c == nil {
+		return fileHash(name)
+	}
+	key, err := filepath.Rel(c.dir, name)
+	if err != nil {
+		return "", err
+	}
+	key = filepath.ToSlash(key)
+	stat, err := os.Stat(name)
+	if err != nil {
+		return "", err
+	}
+	a, ok := c.old.Assets[key]
+	if ok && a.Size == stat.Size() && a.ModTime.Equal(stat.ModTime()) {
+		c.cur.Assets[key] = a
+		return a.Hash, nil
+	}
+	sum, err := fileChecksum(name)
+	if err != nil {
+		return "", err
+	}
+	if ok && a.Size == stat.Size() && a.Checksum == sum {
+		a.ModTime = stat.ModTime()
+		c.cur.Assets[key] = a
+		return a.Hash, nil
+	}
+	h, err := fileHash(name)
+	if err != nil {
+		return "", err
+	}
+	c.cur.Assets[key] = cachedAsset{
+		Size:     stat.Size(),
+		ModTime:  stat.ModTime(),
+		Checksum: sum,
+		Hash:     h,
+	}
+	return h, nil
+}
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// fileChecksum computes a checksum of the contents of the named file which
+// is much cheaper than fileHash: the CRC-32C and CRC-32 (IEEE) checksums,
+// which are both hardware-accelerated on common platforms.
+func fileChecksum(name string) (uint64, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	c, ieee := crc32.New(crc32cTable), crc32.NewIEEE()
+	if _, err := io.Copy(io.MultiWriter(c, ieee), f); err != nil {
+		return 0, err
+	}
+	return uint64(c.Sum32())<<32 | uint64(ieee.Sum32()), nil
+}
+
+// renderMarkdown is like the renderMarkdown function, but it reuses the
+// HTML from a previous build of the same markdown.
+func (c *buildCache) renderMarkdown(input []byte) []byte {
+	if c == nil {
+		return renderMarkdown(input)
+	}
+	sum := sha256.Sum256(input)
+	key := base62Hash(sum[:8]) + base62Hash(sum[8:16])
+	if html, ok := c.cur.Markdown[key]; ok {
+		return []byte(html)
+	}
+	if html, ok := c.old.Markdown[key]; ok {
+		c.cur.Markdown[key] = html
+		return []byte(html)
+	}
+	html := renderMarkdown(input)
+	c.cur.Markdown[key] = string(html)
+	return html
+}
+
+// sitkinVersion identifies the sitkin binary for the purpose of cache
+// invalidation.
+func sitkinVersion() string {
+	v := strconv.Itoa(cacheFormat)
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return v
+	}
+	v += " " + info.Main.Version
+	for _, setting := range info.Settings {
+		switch setting.Key {
+		case "vcs.revision", "vcs.modified":
+			v += " " + setting.Value
+		}
+	}
+	return v
+}
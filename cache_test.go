@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestBuildCache(t *testing.T) {
+	td := newTempDir(t)
+	defer td.remove()
+
+	td.writeFile("sitkin/default.tmpl", `{{block "contents" .}}{{.Contents}}{{end}}`)
+	td.writeFile("sitkin/config.json", `{}`)
+	td.writeFile("x.css", "css")
+	td.writeFile("about.md", "# About")
+
+	build := func(opts options) {
+		t.Helper()
+		s, err := load(td.dir, opts)
+		if err != nil {
+			t.Fatal("load failed:", err)
+		}
+		if err := s.render(context.Background()); err != nil {
+			t.Fatal("render failed:", err)
+		}
+	}
+
+	build(options{})
+	realHash := hashBase62("css")
+	td.checkFile("gen/x."+realHash+".css", "css")
+
+	// Tamper with the cache to check that its entries are used.
+	var data cacheData
+	b, err := os.ReadFile(td.path(".sitkin-cache/cache.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(b, &data); err != nil {
+		t.Fatal(err)
+	}
+	a, ok := data.Assets["x.css"]
+	if !ok || a.Hash != realHash {
+		t.Fatalf("got cached asset %+v; want hash %s", a, realHash)
+	}
+	a.Hash = "cachedhash"
+	data.Assets["x.css"] = a
+	if len(data.Markdown) != 1 {
+		t.Fatalf("got %d cached markdown files; want 1", len(data.Markdown))
+	}
+	for k := range data.Markdown {
+		data.Markdown[k] = "<p>cached</p>"
+	}
+	b, err = json.Marshal(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	td.writeFile(".sitkin-cache/cache.json", string(b))
+
+	build(options{})
+	td.checkFile("gen/x.cachedhash.css", "css")
+	td.checkFile("gen/about.html", "<p>cached")
+
+	// Dev builds don't hash assets, but they keep the cached hashes.
+	build(options{devMode: true})
+	td.checkFile("gen/x.NOHASH.css", "css")
+	build(options{})
+	td.checkFile("gen/x.cachedhash.css", "css")
+
+	// A fresh checkout changes the modification times, but not the
+	// contents.
+	future := time.Now().Add(time.Hour)
+	if err := os.Chtimes(td.path("x.css"), future, future); err != nil {
+		t.Fatal(err)
+	}
+	build(options{})
+	td.checkFile("gen/x.cachedhash.css", "css")
+
+	// Changed contents are hashed again.
+	td.writeFile("x.css", "CSS")
+	build(options{})
+	td.checkFile("gen/x."+hashBase62("CSS")+".css", "CSS")
+	td.writeFile("x.css", "css")
+
+	build(options{noCache: true})
+	td.checkFile("gen/x."+realHash+".css", "css")
+	td.checkFile("gen/about.html", "<h1>About</h1>")
+
+	// Changing the config invalidates the cache.
+	td.writeFile("sitkin/config.json", `{"ignore": []}`)
+	build(options{})
+	td.checkFile("gen/x."+realHash+".css", "css")
+	td.checkFile("gen/about.html", "<h1>About</h1>")
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+)
+
+// precompressConfig configures writing precompressed copies of the output
+// files alongside the originals.
+type precompressConfig struct {
+	Formats []string // "gzip" and/or "br"
+	MinSize int64
+}
+
+// compressExts is the set of output extensions worth precompressing.
+var compressExts = map[string]struct{}{
+	".html": {},
+	".css":  {},
+	".js":   {},
+	".mjs":  {},
+	".svg":  {},
+	".xml":  {},
+	".json": {},
+}
+
+// compressFormats maps each precompression format to the extension of the
+// files it produces.
+var compressFormats = map[string]string{
+	"gzip": ".gz",
+	"br":   ".br",
+}
+
+func (c *precompressConfig) check() error {
+	for _, format := range c.Formats {
+		if _, ok := compressFormats[format]; !ok {
+			return fmt.Errorf("unknown precompression format %q", format)
+		}
+	}
+	if c.MinSize < 0 {
+		return fmt.Errorf("bad precompression min size %d", c.MinSize)
+	}
+	return nil
+}
+
+// precompress writes compressed siblings (x.html.gz, x.html.br, ...) of all
+// the compressible files written by the current render. The siblings of an
+// unchanged output are kept if they are newer than it.
+//
+// Dev builds aren't precompressed: every rebuild rewrites all the pages,
+// and compressing them again is slow.
+func (s *sitkin) precompress() error {
+	c := &s.config.Precompress
+	if len(c.Formats) == 0 || s.devMode {
+		return nil
+	}
+	var names []string
+	for name := range s.outputs {
+		if _, ok := compressExts[strings.ToLower(filepath.Ext(name))]; ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		stat, err := os.Stat(name)
+		if err != nil {
+			return err
+		}
+		if stat.Size() < c.MinSize {
+			continue
+		}
+		_, unchanged := s.unchanged[name]
+		for _, format := range c.Formats {
+			sibling := name + compressFormats[format]
+			if err := s.addOutput(sibling); err != nil {
+				return err
+			}
+			if unchanged {
+				if sstat, err := os.Stat(sibling); err == nil && !sstat.ModTime().Before(stat.ModTime()) {
+					continue
+				}
+			}
+			if err := compressFile(name, format); err != nil {
+				return fmt.Errorf("error compressing %s: %s", name, err)
+			}
+		}
+	}
+	return nil
+}
+
+func compressFile(name, format string) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return writeFileAtomic(name+compressFormats[format], 0o644, func(w io.Writer) error {
+		var zw io.WriteCloser
+		switch format {
+		case "gzip":
+			zw, err = gzip.NewWriterLevel(w, gzip.BestCompression)
+			if err != nil {
+				panic(err) // valid level
+			}
+		case "br":
+			zw = brotli.NewWriterLevel(w, brotli.BestCompression)
+		default:
+			panic("unreachable")
+		}
+		if _, err := io.Copy(zw, f); err != nil {
+			return err
+		}
+		return zw.Close()
+	})
+}
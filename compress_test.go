@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/andybalholm/brotli"
+)
+
+func TestPrecompress(t *testing.T) {
+	td := newTempDir(t)
+	defer td.remove()
+
+	td.writeFile(
+		"sitkin/config.json",
+		`{
+  "nohash": ["*"],
+  "precompress": {
+    "formats": ["gzip", "br"],
+    "minSize": 100
+  }
+}`,
+	)
+	td.writeFile("sitkin/default.tmpl", `{{block "contents" .}}{{end}}`)
+	big := strings.Repeat("<p>hello", 20) // already minified
+	td.writeFile("index.tmpl", `{{define "contents"}}`+big+`{{end}}`)
+	td.writeFile("small.css", "a{}")
+	td.writeFile("big.txt", strings.Repeat("x", 200))
+
+	s, err := load(td.dir, options{})
+	if err != nil {
+		t.Fatal("load failed:", err)
+	}
+	if err := s.render(context.Background()); err != nil {
+		t.Fatal("render failed:", err)
+	}
+
+	td.checkFile("gen/index.html", big)
+	td.checkNotExist("gen/small.css.gz")
+	td.checkNotExist("gen/big.txt.gz")
+
+	gz, err := os.ReadFile(td.path("gen/index.html.gz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(gz))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readAllString(t, zr); got != big {
+		t.Errorf("gzip contents: got %q; want %q", got, big)
+	}
+	br, err := os.ReadFile(td.path("gen/index.html.br"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readAllString(t, brotli.NewReader(bytes.NewReader(br))); got != big {
+		t.Errorf("brotli contents: got %q; want %q", got, big)
+	}
+
+	ds := newDevServer(td.path("gen"))
+	for _, tt := range []struct {
+		accept       string
+		wantEncoding string
+		wantBody     string
+	}{
+		{"", "", big},
+		{"gzip", "gzip", string(gz)},
+		{"gzip, br", "br", string(br)},
+		{"br;q=0, gzip;q=0.5", "gzip", string(gz)},
+	} {
+		req := httptest.NewRequest("GET", "/", nil)
+		if tt.accept != "" {
+			req.Header.Set("Accept-Encoding", tt.accept)
+		}
+		rec := httptest.NewRecorder()
+		ds.ServeHTTP(rec, req)
+		if got := rec.Header().Get("Content-Encoding"); got != tt.wantEncoding {
+			t.Errorf("Accept-Encoding %q: got Content-Encoding %q; want %q", tt.accept, got, tt.wantEncoding)
+		}
+		if got := rec.Header().Get("Content-Type"); got != "text/html; charset=utf-8" {
+			t.Errorf("Accept-Encoding %q: got Content-Type %q", tt.accept, got)
+		}
+		if got := rec.Body.String(); got != tt.wantBody {
+			t.Errorf("Accept-Encoding %q: got wrong body", tt.accept)
+		}
+	}
+}
+
+func readAllString(t *testing.T, r io.Reader) string {
+	t.Helper()
+	b, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestPrecompressUnchanged(t *testing.T) {
+	td := newTempDir(t)
+	defer td.remove()
+
+	td.writeFile("sitkin/config.json", `{"nohash": ["*"], "precompress": {"formats": ["gzip"]}}`)
+	td.writeFile("sitkin/default.tmpl", `{{block "contents" .}}{{end}}`)
+	td.writeFile("index.tmpl", `{{define "contents"}}index{{end}}`)
+	td.writeFile("a.css", "a{}")
+
+	build := func() {
+		t.Helper()
+		s, err := load(td.dir, options{noCache: true})
+		if err != nil {
+			t.Fatal("load failed:", err)
+		}
+		if err := s.render(context.Background()); err != nil {
+			t.Fatal("render failed:", err)
+		}
+	}
+	gunzip := func(name string) string {
+		t.Helper()
+		f, err := os.Open(td.path(name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		zr, err := gzip.NewReader(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return readAllString(t, zr)
+	}
+	build()
+
+	// Mark the compressed files so that we can tell whether they are
+	// written again.
+	for _, name := range []string{"gen/a.css.gz", "gen/index.html.gz"} {
+		td.writeFile(name, "old")
+	}
+	build()
+	td.checkFile("gen/a.css.gz", "old") // the copy of a.css is unchanged
+	if got := gunzip("gen/index.html.gz"); got != "index" {
+		t.Errorf("index.html.gz: got %q; want %q", got, "index")
+	}
+
+	td.writeFile("a.css", "b{}")
+	future := time.Now().Add(time.Hour)
+	if err := os.Chtimes(td.path("a.css"), future, future); err != nil {
+		t.Fatal(err)
+	}
+	build()
+	if got := gunzip("gen/a.css.gz"); got != "b{}" {
+		t.Errorf("a.css.gz: got %q; want %q", got, "b{}")
+	}
+
+	// Dev builds are not precompressed, and the old compressed files are
+	// removed.
+	s, err := load(td.dir, options{devMode: true, noCache: true})
+	if err != nil {
+		t.Fatal("load failed:", err)
+	}
+	if err := s.render(context.Background()); err != nil {
+		t.Fatal("render failed:", err)
+	}
+	td.checkNotExist("gen/index.html.gz")
+	td.checkNotExist("gen/a.css.gz")
+}
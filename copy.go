@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// copyAsset writes cf into dstDir using the configured copy mode. If the
+// destination is already up to date, it is left alone.
+func (s *sitkin) copyAsset(cf *copyFile, dstDir string) error {
+	src := filepath.Join(s.dir, cf.srcPath)
+	dst := filepath.Join(dstDir, cf.dstPath)
+	if err := s.addOutput(dst); err != nil {
+		return err
+	}
+	srcStat, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	// Minified files differ from their sources, so they are always copied.
+	if cf.minify != "" {
+		return cf.copy(s.dir, dstDir)
+	}
+	if dstStat, err := os.Lstat(dst); err == nil {
+		ok, err := upToDate(src, dst, srcStat, dstStat)
+		if err != nil {
+			return err
+		}
+		if ok {
+			s.unchanged[dst] = struct{}{}
+			return nil
+		}
+	}
+	switch s.config.CopyMode {
+	case "hardlink":
+		err = linkFile(src, dst)
+	case "reflink":
+		err = reflinkFile(src, dst)
+	default:
+		return cf.copy(s.dir, dstDir)
+	}
+	if err == nil {
+		return nil
+	}
+	if !s.copyFallback {
+		log.Printf("Warning: cannot %s %s (%s); falling back to copying", s.config.CopyMode, src, err)
+		s.copyFallback = true
+	}
+	return cf.copy(s.dir, dstDir)
+}
+
+// upToDate reports whether the copied file dst has the same contents as src.
+// Copies have the same modification time as their sources, so when the sizes
+// and times match the contents aren't compared.
+func upToDate(src, dst string, srcStat, dstStat os.FileInfo) (bool, error) {
+	if !dstStat.Mode().IsRegular() || dstStat.Size() != srcStat.Size() {
+		return false, nil
+	}
+	if os.SameFile(srcStat, dstStat) || dstStat.ModTime().Equal(srcStat.ModTime()) {
+		return true, nil
+	}
+	same, err := sameContents(src, dst)
+	if err != nil || !same {
+		return false, err
+	}
+	return true, os.Chtimes(dst, time.Time{}, srcStat.ModTime())
+}
+
+func sameContents(name1, name2 string) (bool, error) {
+	f1, err := os.Open(name1)
+	if err != nil {
+		return false, err
+	}
+	defer f1.Close()
+	f2, err := os.Open(name2)
+	if err != nil {
+		return false, err
+	}
+	defer f2.Close()
+	b1 := make([]byte, 64*1024)
+	b2 := make([]byte, 64*1024)
+	for {
+		n1, err1 := io.ReadFull(f1, b1)
+		n2, err2 := io.ReadFull(f2, b2)
+		if !bytes.Equal(b1[:n1], b2[:n2]) {
+			return false, nil
+		}
+		eof1 := err1 == io.EOF || err1 == io.ErrUnexpectedEOF
+		eof2 := err2 == io.EOF || err2 == io.ErrUnexpectedEOF
+		if eof1 || eof2 {
+			return eof1 && eof2, nil
+		}
+		if err1 != nil {
+			return false, err1
+		}
+		if err2 != nil {
+			return false, err2
+		}
+	}
+}
+
+// linkFile replaces dst with a hard link to src.
+func linkFile(src, dst string) error {
+	// Link to the file itself, not to a symlink.
+	src, err := filepath.EvalSymlinks(src)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		return err
+	}
+	const numAttempts = 1000
+	for i := 0; i < numAttempts; i++ {
+		tmp := fmt.Sprintf("%s.tmp.%d", dst, i)
+		err := os.Link(src, tmp)
+		if os.IsExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if err := os.Rename(tmp, dst); err != nil {
+			os.Remove(tmp)
+			return err
+		}
+		return nil
+	}
+	return fmt.Errorf("could not create temp link after %d attempts", numAttempts)
+}
+
+// reflinkFile replaces dst with a copy-on-write clone of src, if the
+// platform and filesystem support it.
+func reflinkFile(src, dst string) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	parent := filepath.Dir(dst)
+	if err := os.MkdirAll(parent, 0o755); err != nil {
+		return err
+	}
+	tmp, err := tempFile(parent, filepath.Base(dst), stat.Mode())
+	if err != nil {
+		return err
+	}
+	if err := reflink(tmp, f); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Chtimes(tmp.Name(), time.Time{}, stat.ModTime()); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), dst)
+}
+
+var errReflinkUnsupported = errors.New("reflinks are not supported on this platform")
+
+// pruneOutputs removes everything in dir that wasn't written by the current
+// render, including directories left empty.
+func (s *sitkin) pruneOutputs(dir string) error {
+	var stale, dirs []string
+	err := filepath.Walk(dir, func(name string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() {
+			if name != dir {
+				dirs = append(dirs, name)
+			}
+			return nil
+		}
+		if _, ok := s.outputs[name]; !ok {
+			stale = append(stale, name)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, name := range stale {
+		if s.verbose {
+			log.Println("Removing stale file", name)
+		}
+		if err := os.Remove(name); err != nil {
+			return err
+		}
+	}
+	// Remove empty directories, deepest first.
+	sort.Sort(sort.Reverse(sort.StringSlice(dirs)))
+	for _, d := range dirs {
+		fis, err := os.ReadDir(d)
+		if err != nil {
+			return err
+		}
+		if len(fis) == 0 {
+			if err := os.Remove(d); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestCopyModes(t *testing.T) {
+	td := newTempDir(t)
+	defer td.remove()
+
+	td.writeFile("sitkin/default.tmpl", "")
+	td.writeFile("a.txt", "aaa")
+	td.writeFile("gen/stale.txt", "stale")
+	td.writeFile("gen/old/dir/x.html", "x")
+
+	build := func(copyMode string) {
+		t.Helper()
+		td.writeFile("sitkin/config.json", `{"nohash": ["*"], "copyMode": "`+copyMode+`"}`)
+		s, err := load(td.dir, options{})
+		if err != nil {
+			t.Fatal("load failed:", err)
+		}
+		if err := s.render(context.Background()); err != nil {
+			t.Fatal("render failed:", err)
+		}
+	}
+	stat := func(name string) os.FileInfo {
+		t.Helper()
+		fi, err := os.Stat(td.path(name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fi
+	}
+
+	build("hardlink")
+	td.checkFile("gen/a.txt", "aaa")
+	td.checkNotExist("gen/stale.txt")
+	td.checkNotExist("gen/old")
+	if !os.SameFile(stat("a.txt"), stat("gen/a.txt")) {
+		t.Fatal("gen/a.txt is not a hard link to a.txt")
+	}
+
+	// A hard link is already up to date, so it stays in place.
+	build("copy")
+	if !os.SameFile(stat("a.txt"), stat("gen/a.txt")) {
+		t.Fatal("gen/a.txt was replaced")
+	}
+
+	// Replacing the source (as editors often do) breaks the link.
+	td.writeFile("a.txt.new", "bbb")
+	if err := os.Rename(td.path("a.txt.new"), td.path("a.txt")); err != nil {
+		t.Fatal(err)
+	}
+	build("copy")
+	td.checkFile("gen/a.txt", "bbb")
+	copied := stat("gen/a.txt")
+	if os.SameFile(stat("a.txt"), copied) {
+		t.Fatal("gen/a.txt is a hard link in copy mode")
+	}
+
+	// An unchanged copy isn't rewritten.
+	build("copy")
+	if !os.SameFile(copied, stat("gen/a.txt")) {
+		t.Error("unchanged gen/a.txt was rewritten")
+	}
+
+	// Same size and a different mtime means the contents are compared.
+	td.writeFile("a.txt", "ccc")
+	if err := os.Chtimes(td.path("a.txt"), time.Time{}, time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	build("copy")
+	td.checkFile("gen/a.txt", "ccc")
+}
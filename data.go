@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// loadData parses the data files in dir (if it exists) for the templates'
+// .Data. A file is named by its path relative to dir without the extension,
+// and each directory is a map, so dir/authors/jane.json is .Data.authors.jane.
+//
+// JSON (.json) and YAML (.yaml or .yml) files may contain any value. A CSV
+// file (.csv) becomes a list of rows, each of which maps the column names
+// from the first row to that row's values.
+func loadData(dir string) (map[string]interface{}, error) {
+	data := make(map[string]interface{})
+	sources := make(map[string]string) // data name -> file, for errors
+	err := walkFollow(dir, func(pth string, fi os.FileInfo, err error) error {
+		if err != nil {
+			if pth == dir && os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if fi.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, pth)
+		if err != nil {
+			panic(err) // shouldn't happen
+		}
+		ext := filepath.Ext(rel)
+		var parse func([]byte) (interface{}, error)
+		switch ext {
+		case ".json":
+			parse = parseJSONData
+		case ".yaml", ".yml":
+			parse = parseYAMLData
+		case ".csv":
+			parse = parseCSVData
+		default:
+			log.Println("Warning: ignoring unexpected file", pth)
+			return nil
+		}
+		name := filepath.ToSlash(strings.TrimSuffix(rel, ext))
+		if other, ok := sources[name]; ok {
+			return fmt.Errorf("data files %s and %s have the same name", other, pth)
+		}
+		sources[name] = pth
+		b, err := os.ReadFile(pth)
+		if err != nil {
+			return err
+		}
+		v, err := parse(b)
+		if err != nil {
+			return fmt.Errorf("error loading data file %s: %s", pth, err)
+		}
+		return setData(data, name, v)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// setData stores v in data at the slash-separated name, creating nested
+// maps for the directories.
+func setData(data map[string]interface{}, name string, v interface{}) error {
+	parts := strings.Split(name, "/")
+	m := data
+	for i, part := range parts[:len(parts)-1] {
+		switch sub := m[part].(type) {
+		case nil:
+			next := make(map[string]interface{})
+			m[part] = next
+			m = next
+		case map[string]interface{}:
+			m = sub
+		default:
+			return fmt.Errorf("data %s is both a file and a directory", strings.Join(parts[:i+1], "/"))
+		}
+	}
+	last := parts[len(parts)-1]
+	if _, ok := m[last]; ok {
+		return fmt.Errorf("data %s is both a file and a directory", name)
+	}
+	m[last] = v
+	return nil
+}
+
+func parseJSONData(b []byte) (interface{}, error) {
+	var v interface{}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+func parseYAMLData(b []byte) (interface{}, error) {
+	var v interface{}
+	if err := yaml.Unmarshal(b, &v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+func parseCSVData(b []byte) (interface{}, error) {
+	records, err := csv.NewReader(strings.NewReader(string(b))).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	rows := []map[string]string{}
+	if len(records) == 0 {
+		return rows, nil
+	}
+	header := records[0]
+	for _, record := range records[1:] {
+		row := make(map[string]string, len(header))
+		for i, col := range header {
+			row[col] = record[i]
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
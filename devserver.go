@@ -0,0 +1,314 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"io"
+	"mime"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// devServer serves the generated files in dev mode. It mimics the behavior
+// of common static hosts: a request for /x may be served by x, x.html, or
+// x/index.html; redirects (including aliases) are served as HTTP redirects
+// rather than as stub pages; and missing files are served by 404.html (if
+// it exists).
+//
+// Requests matching a configured devProxy prefix are forwarded to an
+// upstream server instead. While the latest build is failing, every other
+// request is served a page describing the error.
+type devServer struct {
+	dir string // the gen dir
+
+	mu        sync.Mutex
+	redirects map[string]string
+	proxies   []*devProxy // longest prefix first
+	buildErr  error       // nil if the last build succeeded
+	buildTime time.Time   // when the failed build happened
+}
+
+type devProxy struct {
+	prefix string
+	proxy  *httputil.ReverseProxy
+}
+
+func newDevServer(dir string) *devServer {
+	return &devServer{dir: dir}
+}
+
+// update applies the settings of a newly built site.
+func (ds *devServer) update(s *sitkin) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	ds.buildErr = nil
+	ds.redirects = make(map[string]string)
+	for _, r := range s.redirects {
+		ds.redirects[r.from] = r.to
+	}
+	ds.proxies = nil
+	for prefix, upstream := range s.config.DevProxy {
+		target, err := parseUpstream(upstream)
+		if err != nil {
+			panic(err) // already checked
+		}
+		ds.proxies = append(ds.proxies, &devProxy{
+			prefix: prefix,
+			proxy: &httputil.ReverseProxy{
+				Rewrite: func(pr *httputil.ProxyRequest) {
+					pr.SetURL(target)
+					pr.SetXForwarded()
+				},
+			},
+		})
+	}
+	sort.Slice(ds.proxies, func(i, j int) bool {
+		return len(ds.proxies[i].prefix) > len(ds.proxies[j].prefix)
+	})
+}
+
+// fail records that a build failed with err. The settings from the last
+// successful build remain in effect.
+func (ds *devServer) fail(err error) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	ds.buildErr = err
+	ds.buildTime = time.Now()
+}
+
+// parseUpstream parses the URL of a devProxy upstream server.
+func parseUpstream(upstream string) (*url.URL, error) {
+	u, err := url.Parse(upstream)
+	if err != nil {
+		return nil, err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("upstream %q is not an http or https URL", upstream)
+	}
+	return u, nil
+}
+
+func (ds *devServer) findProxy(upath string) *httputil.ReverseProxy {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	for _, p := range ds.proxies {
+		if strings.HasPrefix(upath, p.prefix) {
+			return p.proxy
+		}
+	}
+	return nil
+}
+
+func (ds *devServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if proxy := ds.findProxy(r.URL.Path); proxy != nil {
+		proxy.ServeHTTP(w, r)
+		return
+	}
+	// Dev builds change constantly (and NOHASH asset names never change),
+	// so nothing should be cached.
+	w.Header().Set("Cache-Control", "no-store")
+	if ds.serveBuildError(w) {
+		return
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	upath := path.Clean("/" + r.URL.Path)
+	if target, ok := ds.redirect(r.URL.Path, upath); ok {
+		http.Redirect(w, r, target, http.StatusMovedPermanently)
+		return
+	}
+	name, isIndex := ds.resolve(upath)
+	if name == "" {
+		ds.notFound(w, r)
+		return
+	}
+	if isIndex && !strings.HasSuffix(r.URL.Path, "/") {
+		http.Redirect(w, r, strings.TrimSuffix(upath, "/")+"/", http.StatusMovedPermanently)
+		return
+	}
+	ds.serveFile(w, r, name)
+}
+
+func (ds *devServer) redirect(paths ...string) (target string, ok bool) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	for _, p := range paths {
+		if target, ok := ds.redirects[p]; ok {
+			return target, true
+		}
+	}
+	return "", false
+}
+
+// resolve finds the file that serves the URL path upath, trying the file
+// itself, then the file with .html appended, and then index.html inside a
+// directory. It returns the empty string if there is no such file.
+func (ds *devServer) resolve(upath string) (name string, isIndex bool) {
+	base := filepath.Join(ds.dir, filepath.FromSlash(upath))
+	if isRegularFile(base) {
+		return base, false
+	}
+	if upath != "/" && isRegularFile(base+".html") {
+		return base + ".html", false
+	}
+	if index := filepath.Join(base, "index.html"); isRegularFile(index) {
+		return index, true
+	}
+	return "", false
+}
+
+func isRegularFile(name string) bool {
+	stat, err := os.Stat(name)
+	return err == nil && stat.Mode().IsRegular()
+}
+
+func (ds *devServer) notFound(w http.ResponseWriter, r *http.Request) {
+	f, err := os.Open(filepath.Join(ds.dir, "404.html"))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusNotFound)
+	if r.Method != http.MethodHead {
+		io.Copy(w, f)
+	}
+}
+
+// serveFile serves the file name, or a precompressed sibling of it if there
+// is one that the client accepts.
+func (ds *devServer) serveFile(w http.ResponseWriter, r *http.Request, name string) {
+	h := w.Header()
+	if ctype := mime.TypeByExtension(filepath.Ext(name)); ctype != "" {
+		h.Set("Content-Type", ctype)
+	}
+	for _, enc := range []struct {
+		encoding string
+		ext      string
+	}{
+		{"br", ".br"},
+		{"gzip", ".gz"},
+	} {
+		if !acceptsEncoding(r.Header.Get("Accept-Encoding"), enc.encoding) {
+			continue
+		}
+		f, err := os.Open(name + enc.ext)
+		if err != nil {
+			continue
+		}
+		defer f.Close()
+		stat, err := f.Stat()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		h.Set("Content-Encoding", enc.encoding)
+		h.Add("Vary", "Accept-Encoding")
+		http.ServeContent(w, r, filepath.Base(name), stat.ModTime(), f)
+		return
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	http.ServeContent(w, r, filepath.Base(name), stat.ModTime(), f)
+}
+
+// acceptsEncoding reports whether the Accept-Encoding header value header
+// allows the content coding enc.
+func acceptsEncoding(header, enc string) bool {
+	for _, part := range strings.Split(header, ",") {
+		coding, params, _ := strings.Cut(part, ";")
+		if strings.TrimSpace(coding) != enc {
+			continue
+		}
+		for _, param := range strings.Split(params, ";") {
+			k, v, _ := strings.Cut(strings.TrimSpace(param), "=")
+			if k == "q" {
+				q, err := strconv.ParseFloat(v, 64)
+				return err == nil && q > 0
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// serveBuildError serves the error page if the last build failed. It
+// reports whether it did so.
+func (ds *devServer) serveBuildError(w http.ResponseWriter) bool {
+	ds.mu.Lock()
+	err, t := ds.buildErr, ds.buildTime
+	ds.mu.Unlock()
+	if err == nil {
+		return false
+	}
+	file, line := errorLocation(err)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusInternalServerError)
+	buildErrorTmpl.Execute(w, struct {
+		Err  string
+		File string
+		Line int
+		Time time.Time
+	}{err.Error(), file, line, t})
+	return true
+}
+
+// templateErrorLocation matches the location in text/template errors
+// ("template: x.tmpl:12: ...") and in html/template escaping errors
+// ("html/template:x.tmpl:12:4: ...").
+var templateErrorLocation = regexp.MustCompile(`(?:template: |html/template:)(\S+?):(\d+):`)
+
+// errorLocation extracts the file name and line number from a template
+// parse, escaping, or execution error. It returns an empty file name if err doesn't
+// indicate a location.
+func errorLocation(err error) (file string, line int) {
+	m := templateErrorLocation.FindStringSubmatch(err.Error())
+	if m == nil {
+		return "", 0
+	}
+	line, _ = strconv.Atoi(m[2])
+	return m[1], line
+}
+
+var buildErrorTmpl = template.Must(template.New("").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Build failed</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+pre { background: #fee; padding: 1em; white-space: pre-wrap; }
+</style>
+</head>
+<body>
+<h1>Build failed</h1>
+{{with .File}}<p>In <code>{{.}}</code>, line {{$.Line}}:</p>{{end}}
+<pre>{{.Err}}</pre>
+<p>The build failed at {{.Time.Format "15:04:05 on Jan 2, 2006"}}. This page
+will be replaced by the site once a build succeeds.</p>
+</body>
+</html>
+`))
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDevServer(t *testing.T) {
+	td := newTempDir(t)
+	defer td.remove()
+
+	td.writeFile("gen/index.html", "index")
+	td.writeFile("gen/about.html", "about")
+	td.writeFile("gen/posts/hello.html", "hello")
+	td.writeFile("gen/docs/index.html", "docs")
+	td.writeFile("gen/x.css", "css")
+	td.writeFile("gen/404.html", "not found")
+
+	ds := newDevServer(td.path("gen"))
+	ds.update(&sitkin{
+		redirects: []*redirect{
+			{from: "/old-about", to: "/about"},
+			{from: "/old/", to: "/posts/hello"},
+		},
+	})
+
+	for _, tt := range []struct {
+		path         string
+		wantCode     int
+		wantBody     string
+		wantLocation string
+	}{
+		{path: "/", wantCode: 200, wantBody: "index"},
+		{path: "/about", wantCode: 200, wantBody: "about"},
+		{path: "/about.html", wantCode: 200, wantBody: "about"},
+		{path: "/posts/hello", wantCode: 200, wantBody: "hello"},
+		{path: "/docs/", wantCode: 200, wantBody: "docs"},
+		{path: "/docs", wantCode: 301, wantLocation: "/docs/"},
+		{path: "/x.css", wantCode: 200, wantBody: "css"},
+		{path: "/old-about", wantCode: 301, wantLocation: "/about"},
+		{path: "/old/", wantCode: 301, wantLocation: "/posts/hello"},
+		{path: "/missing", wantCode: 404, wantBody: "not found"},
+		{path: "/posts/", wantCode: 404, wantBody: "not found"},
+	} {
+		rec := httptest.NewRecorder()
+		ds.ServeHTTP(rec, httptest.NewRequest("GET", tt.path, nil))
+		if rec.Code != tt.wantCode {
+			t.Errorf("GET %s: got status %d; want %d", tt.path, rec.Code, tt.wantCode)
+			continue
+		}
+		if got := rec.Header().Get("Cache-Control"); got != "no-store" {
+			t.Errorf("GET %s: got Cache-Control %q; want no-store", tt.path, got)
+		}
+		if tt.wantLocation != "" {
+			if got := rec.Header().Get("Location"); got != tt.wantLocation {
+				t.Errorf("GET %s: got Location %q; want %q", tt.path, got, tt.wantLocation)
+			}
+			continue
+		}
+		if got := rec.Body.String(); got != tt.wantBody {
+			t.Errorf("GET %s: got body %q; want %q", tt.path, got, tt.wantBody)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	ds.ServeHTTP(rec, httptest.NewRequest("POST", "/", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST /: got status %d; want %d", rec.Code, http.StatusMethodNotAllowed)
+	}
+}
+
+func TestDevServerProxy(t *testing.T) {
+	td := newTempDir(t)
+	defer td.remove()
+	td.writeFile("gen/api.html", "not proxied")
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s %s %s", r.Method, r.URL.Path, r.Header.Get("X-Forwarded-Host"))
+	}))
+	defer upstream.Close()
+	v2 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "v2 %s", r.URL.Path)
+	}))
+	defer v2.Close()
+
+	ds := newDevServer(td.path("gen"))
+	var s sitkin
+	s.config.DevProxy = map[string]string{
+		"/api/":    upstream.URL,
+		"/api/v2/": v2.URL,
+	}
+	ds.update(&s)
+
+	for _, tt := range []struct {
+		method string
+		path   string
+		want   string
+	}{
+		{"GET", "/api/users", "GET /api/users example.com"},
+		{"POST", "/api/users", "POST /api/users example.com"},
+		{"GET", "/api/v2/users", "v2 /api/v2/users"},
+		{"GET", "/api", "not proxied"},
+	} {
+		rec := httptest.NewRecorder()
+		ds.ServeHTTP(rec, httptest.NewRequest(tt.method, tt.path, nil))
+		if got := rec.Body.String(); got != tt.want {
+			t.Errorf("%s %s: got %q; want %q", tt.method, tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestDevServerBuildError(t *testing.T) {
+	td := newTempDir(t)
+	defer td.remove()
+
+	td.writeFile("sitkin/config.json", `{"filesets": ["posts"]}`)
+	td.writeFile("sitkin/default.tmpl", "")
+	td.writeFile("sitkin/posts.tmpl", "")
+	td.writeFile("posts/2018-03-05.hello.md", `<!--
+{"title": "Hello"}
+-->
+# Hello
+
+{{nope}}
+`)
+	td.writeFile("gen/index.html", "index")
+
+	_, err := load(td.dir, options{})
+	if err == nil {
+		t.Fatal("load succeeded unexpectedly")
+	}
+	file, line := errorLocation(err)
+	if want := td.path("posts/2018-03-05.hello.md"); file != want || line != 6 {
+		t.Errorf("errorLocation: got %s:%d; want %s:6", file, line, want)
+	}
+
+	ds := newDevServer(td.path("gen"))
+	ds.fail(err)
+	rec := httptest.NewRecorder()
+	ds.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if rec.Code != http.StatusInternalServerError {
+		t.Errorf("got status %d; want %d", rec.Code, http.StatusInternalServerError)
+	}
+	body := rec.Body.String()
+	for _, want := range []string{"Build failed", "2018-03-05.hello.md</code>, line 6", `function &#34;nope&#34; not defined`} {
+		if !strings.Contains(body, want) {
+			t.Errorf("error page does not contain %q:\n%s", want, body)
+		}
+	}
+
+	ds.update(&sitkin{})
+	rec = httptest.NewRecorder()
+	ds.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if rec.Code != 200 || rec.Body.String() != "index" {
+		t.Errorf("after successful build: got %d %q", rec.Code, rec.Body.String())
+	}
+}
+
+func TestErrorLocation(t *testing.T) {
+	td := newTempDir(t)
+	defer td.remove()
+
+	td.writeFile("sitkin/default.tmpl", `{{block "contents" .}}{{end}}`)
+	// The branches of the if end in different HTML contexts, which is an
+	// escaping error.
+	td.writeFile("index.tmpl", "{{define \"contents\"}}\n<a {{if .DevMode}}href=\"{{end}}>x</a>{{end}}")
+	s, err := load(td.dir, options{})
+	if err != nil {
+		t.Fatal("load failed:", err)
+	}
+	err = s.render(context.Background())
+	if err == nil {
+		t.Fatal("render succeeded unexpectedly")
+	}
+	if file, line := errorLocation(err); file != "index.tmpl" || line != 2 {
+		t.Errorf("errorLocation(%q): got %s:%d; want index.tmpl:2", err, file, line)
+	}
+
+	for _, tt := range []struct {
+		msg  string
+		file string
+		line int
+	}{
+		{`template: x.tmpl:12: function "nope" not defined`, "x.tmpl", 12},
+		{`template: x.tmpl:3:5: executing "x.tmpl" at <.X>: nil pointer`, "x.tmpl", 3},
+		{`html/template:x.tmpl:7:14: {{.}} appears in an ambiguous context within a URL`, "x.tmpl", 7},
+		{`html/template: "x" is an incomplete template`, "", 0},
+		{"cannot open file", "", 0},
+	} {
+		if file, line := errorLocation(errors.New(tt.msg)); file != tt.file || line != tt.line {
+			t.Errorf("errorLocation(%q): got %s:%d; want %s:%d", tt.msg, file, line, tt.file, tt.line)
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// devTLSConfig returns a TLS config for the dev server using a self-signed
+// certificate that is valid for localhost and the given IP addresses.
+//
+// The certificate is saved in the cache dir and reused until it expires or
+// the addresses change, so that a device only has to trust it once.
+func devTLSConfig(dir string, ips []net.IP) (*tls.Config, error) {
+	certFile := filepath.Join(dir, cacheDirName, "dev-cert.pem")
+	keyFile := filepath.Join(dir, cacheDirName, "dev-key.pem")
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err == nil && devCertValid(cert, ips) {
+		return &tls.Config{Certificates: []tls.Certificate{cert}}, nil
+	}
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Println("Warning: ignoring bad dev certificate:", err)
+	}
+
+	certPEM, keyPEM, err := generateDevCert(ips)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range []struct {
+		name     string
+		contents []byte
+		mode     os.FileMode
+	}{
+		{certFile, certPEM, 0o644},
+		{keyFile, keyPEM, 0o600},
+	} {
+		err := writeFileAtomic(f.name, f.mode, func(w io.Writer) error {
+			_, err := w.Write(f.contents)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	log.Println("Generated a self-signed certificate for the dev server:", certFile)
+	cert, err = tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{Certificates: []tls.Certificate{cert}}, nil
+}
+
+// devCertValid reports whether cert is unexpired and valid for all of ips.
+func devCertValid(cert tls.Certificate, ips []net.IP) bool {
+	if len(cert.Certificate) == 0 {
+		return false
+	}
+	c, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return false
+	}
+	if time.Now().Add(24 * time.Hour).After(c.NotAfter) {
+		return false
+	}
+	for _, ip := range ips {
+		if c.VerifyHostname(ip.String()) != nil {
+			return false
+		}
+	}
+	return true
+}
+
+func generateDevCert(ips []net.IP) (certPEM, keyPEM []byte, err error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, err
+	}
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"sitkin dev server"}},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.AddDate(1, 0, 0),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           append([]net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback}, ips...),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+	return certPEM, keyPEM, nil
+}
+
+// lanIPs returns this machine's non-loopback unicast IP addresses.
+func lanIPs() []net.IP {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		log.Println("Warning: cannot list network addresses:", err)
+		return nil
+	}
+	var ips []net.IP
+	for _, addr := range addrs {
+		ipnet, ok := addr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		ip := ipnet.IP
+		if ip.IsLoopback() || ip.IsLinkLocalUnicast() || !ip.IsGlobalUnicast() {
+			continue
+		}
+		ips = append(ips, ip)
+	}
+	return ips
+}
+
+// devURLs returns the URLs at which the dev server listening on addr can
+// be reached. If it listens on all interfaces, the URLs include each LAN
+// address.
+func devURLs(scheme string, addr net.Addr, ips []net.IP) []string {
+	host, port, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return []string{scheme + "://" + addr.String()}
+	}
+	if ip := net.ParseIP(host); ip == nil || !ip.IsUnspecified() {
+		return []string{scheme + "://" + addr.String()}
+	}
+	urls := []string{scheme + "://localhost:" + port}
+	for _, ip := range ips {
+		urls = append(urls, scheme+"://"+net.JoinHostPort(ip.String(), port))
+	}
+	return urls
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestDevTLSConfig(t *testing.T) {
+	td := newTempDir(t)
+	defer td.remove()
+
+	ips := []net.IP{net.ParseIP("192.168.1.5")}
+	cfg1, err := devTLSConfig(td.dir, ips)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := cfg1.Certificates[0]
+	if !devCertValid(cert, ips) {
+		t.Fatal("generated certificate is not valid for", ips)
+	}
+	if devCertValid(cert, []net.IP{net.ParseIP("10.0.0.1")}) {
+		t.Fatal("generated certificate is valid for an unexpected address")
+	}
+
+	// The certificate is reused if it's still valid.
+	cfg2, err := devTLSConfig(td.dir, ips)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(cfg2.Certificates[0].Certificate[0], cert.Certificate[0]) {
+		t.Error("certificate was regenerated")
+	}
+	cfg3, err := devTLSConfig(td.dir, append(ips, net.ParseIP("10.0.0.1")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(cfg3.Certificates[0].Certificate[0], cert.Certificate[0]) {
+		t.Error("certificate was not regenerated for a new address")
+	}
+}
+
+func TestDevURLs(t *testing.T) {
+	ips := []net.IP{net.ParseIP("192.168.1.5"), net.ParseIP("fd00::1")}
+	for _, tt := range []struct {
+		addr string
+		want []string
+	}{
+		{"127.0.0.1:8080", []string{"https://127.0.0.1:8080"}},
+		{
+			"0.0.0.0:8080",
+			[]string{"https://localhost:8080", "https://192.168.1.5:8080", "https://[fd00::1]:8080"},
+		},
+		{
+			"[::]:8080",
+			[]string{"https://localhost:8080", "https://192.168.1.5:8080", "https://[fd00::1]:8080"},
+		},
+	} {
+		addr, err := net.ResolveTCPAddr("tcp", tt.addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := devURLs("https", addr, ips); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("devURLs(%s): got %q; want %q", tt.addr, got, tt.want)
+		}
+	}
+}
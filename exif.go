@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/draw"
+	"io"
+)
+
+// jpegOrientation returns the EXIF orientation (1 through 8) of the JPEG
+// image read from r. Images without a valid orientation tag have the
+// normal orientation, 1.
+func jpegOrientation(r io.Reader) (int, error) {
+	br := bufio.NewReader(r)
+	var soi [2]byte
+	if _, err := io.ReadFull(br, soi[:]); err != nil {
+		return 0, err
+	}
+	if soi != [2]byte{0xff, 0xd8} {
+		return 0, errors.New("not a JPEG image")
+	}
+	for {
+		var marker [4]byte
+		if _, err := io.ReadFull(br, marker[:2]); err != nil {
+			return 0, err
+		}
+		if marker[0] != 0xff {
+			return 0, errors.New("bad JPEG marker")
+		}
+		switch marker[1] {
+		case 0xd9, 0xda: // end of image, start of scan
+			return 1, nil
+		}
+		if _, err := io.ReadFull(br, marker[2:]); err != nil {
+			return 0, err
+		}
+		n := int(binary.BigEndian.Uint16(marker[2:])) - 2
+		if n < 0 {
+			return 0, errors.New("bad JPEG segment length")
+		}
+		if marker[1] != 0xe1 { // APP1
+			if _, err := br.Discard(n); err != nil {
+				return 0, err
+			}
+			continue
+		}
+		b := make([]byte, n)
+		if _, err := io.ReadFull(br, b); err != nil {
+			return 0, err
+		}
+		if bytes.HasPrefix(b, []byte("Exif\x00\x00")) {
+			return exifOrientation(b[6:]), nil
+		}
+	}
+}
+
+// exifOrientation finds the orientation tag in the first IFD of the TIFF
+// structure b.
+func exifOrientation(b []byte) int {
+	if len(b) < 8 {
+		return 1
+	}
+	var order binary.ByteOrder
+	switch string(b[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+	if order.Uint16(b[2:]) != 42 {
+		return 1
+	}
+	ifd := int(order.Uint32(b[4:]))
+	if ifd < 8 || ifd+2 > len(b) {
+		return 1
+	}
+	n := int(order.Uint16(b[ifd:]))
+	for i := 0; i < n; i++ {
+		e := ifd + 2 + 12*i
+		if e+12 > len(b) {
+			break
+		}
+		const tagOrientation, typeShort = 0x0112, 3
+		if order.Uint16(b[e:]) != tagOrientation || order.Uint16(b[e+2:]) != typeShort {
+			continue
+		}
+		if o := int(order.Uint16(b[e+8:])); o >= 1 && o <= 8 {
+			return o
+		}
+		break
+	}
+	return 1
+}
+
+// orientationSwapsAxes reports whether an image with the EXIF orientation o
+// is displayed with its width and height swapped.
+func orientationSwapsAxes(o int) bool {
+	return o >= 5
+}
+
+// applyOrientation transforms src, which has the EXIF orientation o, so
+// that it is upright.
+func applyOrientation(src image.Image, o int) image.Image {
+	if o <= 1 || o > 8 {
+		return src
+	}
+	b := src.Bounds()
+	m := image.NewNRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(m, m.Bounds(), src, b.Min, draw.Src)
+	w, h := b.Dx(), b.Dy()
+	dw, dh := w, h
+	if orientationSwapsAxes(o) {
+		dw, dh = h, w
+	}
+	dst := image.NewNRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		for x := 0; x < dw; x++ {
+			var sx, sy int
+			switch o {
+			case 2: // mirrored horizontally
+				sx, sy = w-1-x, y
+			case 3: // rotated 180°
+				sx, sy = w-1-x, h-1-y
+			case 4: // mirrored vertically
+				sx, sy = x, h-1-y
+			case 5: // transposed
+				sx, sy = y, x
+			case 6: // needs a 90° clockwise rotation
+				sx, sy = y, h-1-x
+			case 7: // transversed
+				sx, sy = w-1-y, h-1-x
+			case 8: // needs a 90° counterclockwise rotation
+				sx, sy = w-1-y, x
+			}
+			copy(dst.Pix[dst.PixOffset(x, y):][:4], m.Pix[m.PixOffset(sx, sy):][:4])
+		}
+	}
+	return dst
+}
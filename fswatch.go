@@ -2,9 +2,14 @@ package main
 
 import (
 	"errors"
+	"fmt"
 	"log"
 	"os"
+	"path"
 	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/fsnotify/fsnotify"
@@ -12,37 +17,266 @@ import (
 
 const debugWatch = false
 
-func watchDir(dir string, delay time.Duration, fn func(), ignore string) error {
+// pollInterval is how often the project is scanned for changes when
+// fsnotify cannot be used.
+const pollInterval = time.Second
+
+// watchDir calls fn with the files in the project dir (and in the extra dirs
+// listed in the config) that changed, waiting until there have been no
+// changes for delay. Symbolic links are followed. Changes to the named
+// top-level entries in ignore, to other top-level entries beginning with a
+// dot, to files which the config's ignore globs exclude from the build, and
+// to editor temp files are ignored. The config is read with the named
+// profile applied.
+func watchDir(dir, profile string, delay time.Duration, fn func([]change), ignore ...string) error {
+	w := newWatcher(dir, profile, delay, fn, ignore...)
 	fw, err := fsnotify.NewWatcher()
 	if err != nil {
+		log.Printf("Cannot watch for changes using fsnotify (%s); polling every %s instead", err, pollInterval)
+		return w.poll()
+	}
+	w.w = fw
+	if err := w.addDir(dir); err != nil {
+		if isWatchLimit(err) {
+			return w.fallBackToPolling(err)
+		}
 		return err
 	}
+	if err := w.addRoots(); err != nil {
+		return w.fallBackToPolling(err)
+	}
+	return w.watch()
+}
+
+func newWatcher(dir, profile string, delay time.Duration, fn func([]change), ignore ...string) *watcher {
 	w := &watcher{
-		w:      fw,
-		dir:    dir,
-		ignore: map[string]struct{}{filepath.Join(dir, ignore): {}},
-		delay:  delay,
-		fn:     fn,
+		dir:        dir,
+		profile:    profile,
+		configFile: filepath.Join(dir, "sitkin", "config.json"),
+		ignoreTop:  make(map[string]struct{}),
+		watched:    make(map[string]struct{}),
+		pending:    make(map[string]fsnotify.Op),
+		delay:      delay,
+		fn:         fn,
 	}
-	if err := w.addDir(dir); err != nil {
-		return err
+	for _, name := range ignore {
+		w.ignoreTop[name] = struct{}{}
 	}
-	errc := make(chan error)
-	go func() { errc <- w.watch() }()
-	select {
-	case err := <-fw.Errors:
-		return err
-	case err := <-errc:
+	w.loadConfig()
+	return w
+}
+
+type watcher struct {
+	w           *fsnotify.Watcher
+	dir         string
+	profile     string // config profile
+	configFile  string
+	ignoreTop   map[string]struct{}    // top-level names
+	ignoreGlobs []string               // from the config
+	readTop     map[string]struct{}    // top-level dirs that load always reads
+	readPaths   map[string]struct{}    // bundle sources and the dirs containing them
+	roots       []string               // extra dirs to watch, from the config
+	watched     map[string]struct{}    // dirs with fsnotify watches
+	pending     map[string]fsnotify.Op // changes since fn was last called
+	delay       time.Duration
+	fn          func([]change)
+}
+
+// A change is a file or directory that changed while the watcher was
+// waiting to call its function, along with all the operations on it.
+// A change to the project dir itself means that some changes were lost.
+type change struct {
+	name string
+	op   fsnotify.Op
+}
+
+func (c change) String() string {
+	return fmt.Sprintf("%s (%s)", c.name, c.op)
+}
+
+// needsFullReload reports whether changes (to the project in dir) require
+// reloading everything, including the templates in the sitkin dir. Since
+// files outside the project may be linked into the sitkin dir, changes to
+// them require a full reload as well.
+func needsFullReload(dir string, changes []change) bool {
+	dir = filepath.Clean(dir)
+	sitkinDir := filepath.Join(dir, "sitkin")
+	for _, c := range changes {
+		if c.name == dir || c.name == sitkinDir ||
+			strings.HasPrefix(c.name, sitkinDir+string(filepath.Separator)) ||
+			outsideDir(dir, c.name) {
+			return true
+		}
+	}
+	return false
+}
+
+// outsideDir reports whether the file name is outside of dir.
+func outsideDir(dir, name string) bool {
+	rel, err := filepath.Rel(dir, name)
+	return err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// flush calls fn with the pending changes, sorted by name.
+func (w *watcher) flush() {
+	changes := make([]change, 0, len(w.pending))
+	for name, op := range w.pending {
+		changes = append(changes, change{name, op})
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].name < changes[j].name
+	})
+	w.pending = make(map[string]fsnotify.Op)
+	w.fn(changes)
+}
+
+// loadConfig reads the ignore globs, the paths they don't apply to, and
+// the extra dirs to watch from the config file. If the config cannot be read, the previous settings remain
+// in effect.
+func (w *watcher) loadConfig() {
+	var cfg config
+	if _, err := readConfig(w.dir, w.profile, &cfg); err != nil {
+		log.Println("Warning: cannot read config for watching changes:", err)
+		return
+	}
+	w.roots = nil
+	for _, root := range cfg.Watch {
+		if !filepath.IsAbs(root) {
+			root = filepath.Join(w.dir, root)
+		}
+		w.roots = append(w.roots, filepath.Clean(root))
+	}
+	var globs []string
+	for _, glob := range cfg.Ignore {
+		if _, err := path.Match(glob, ""); err != nil {
+			log.Printf("Warning: bad ignore glob %q", glob)
+			continue
+		}
+		globs = append(globs, glob)
+	}
+	w.ignoreGlobs = globs
+
+	// Like load, the ignore globs only apply to files which would be
+	// copied: file sets are always read, and so are bundle sources (and
+	// thus the dirs containing them).
+	w.readTop = map[string]struct{}{"sitkin": {}}
+	for _, name := range cfg.FileSets {
+		w.readTop[name] = struct{}{}
+	}
+	w.readPaths = make(map[string]struct{})
+	for _, srcs := range cfg.Bundles {
+		for _, src := range srcs {
+			for p := path.Clean(src); p != "." && p != "/"; p = path.Dir(p) {
+				w.readPaths[p] = struct{}{}
+			}
+		}
+	}
+}
+
+// ignored reports whether changes to the file name should be ignored.
+// Outside of the project dir, only editor temp files are ignored.
+func (w *watcher) ignored(name string) bool {
+	if outsideDir(w.dir, name) {
+		return isEditorTemp(filepath.Base(name))
+	}
+	rel, err := filepath.Rel(w.dir, name)
+	if err != nil || rel == "." {
+		return false
+	}
+	rel = filepath.ToSlash(rel)
+	parts := strings.Split(rel, "/")
+	if _, ok := w.ignoreTop[parts[0]]; ok || strings.HasPrefix(parts[0], ".") {
+		return true
+	}
+	if isEditorTemp(parts[len(parts)-1]) {
+		return true
+	}
+	// The ignore globs only apply to files that load would copy.
+	if _, ok := w.readTop[parts[0]]; ok {
+		return false
+	}
+	if _, ok := w.readPaths[rel]; ok {
+		return false
+	}
+	if len(parts) == 1 {
+		switch path.Ext(rel) {
+		case ".md", ".tmpl", ".tpl":
+			return false // pages are never ignored
+		}
+	}
+	// Like load, a matching directory ignores everything inside it.
+	for i := range parts {
+		prefix := strings.Join(parts[:i+1], "/")
+		for _, glob := range w.ignoreGlobs {
+			if match, _ := path.Match(glob, prefix); match {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isEditorTemp reports whether the base name of a file looks like a swap,
+// backup, or lock file written by an editor (or other files that don't
+// belong to the project, like .DS_Store).
+func isEditorTemp(base string) bool {
+	switch {
+	case strings.HasSuffix(base, ".swp"),
+		strings.HasSuffix(base, ".swx"),
+		strings.HasSuffix(base, ".swo"),
+		strings.HasSuffix(base, "~"),
+		strings.HasPrefix(base, ".#"),
+		len(base) > 1 && strings.HasPrefix(base, "#") && strings.HasSuffix(base, "#"),
+		base == "4913", // vim's test for whether it can write in a dir
+		base == ".DS_Store":
+		return true
+	}
+	return false
+}
+
+// reloadConfig rereads the config after the config file changes and
+// adjusts the watched dirs to match.
+func (w *watcher) reloadConfig() error {
+	oldRoots := w.roots
+	w.loadConfig()
+	for _, root := range oldRoots {
+		if !w.isRoot(root) {
+			w.removeDir(root)
+		}
+	}
+	for name := range w.watched {
+		if w.ignored(name) {
+			w.removeDir(name)
+		}
+	}
+	if err := w.addDir(w.dir); err != nil {
 		return err
 	}
+	return w.addRoots()
 }
 
-type watcher struct {
-	w      *fsnotify.Watcher
-	dir    string
-	ignore map[string]struct{}
-	delay  time.Duration
-	fn     func()
+func (w *watcher) isRoot(dir string) bool {
+	for _, root := range w.roots {
+		if root == dir {
+			return true
+		}
+	}
+	return false
+}
+
+// addRoots watches the extra dirs from the config. A dir that cannot be
+// watched is skipped with a warning unless the watch limit was reached, in
+// which case the error is returned.
+func (w *watcher) addRoots() error {
+	for _, root := range w.roots {
+		if err := w.addDir(root); err != nil {
+			if isWatchLimit(err) {
+				return err
+			}
+			log.Printf("Warning: cannot watch %s: %s", root, err)
+		}
+	}
+	return nil
 }
 
 const chmodMask fsnotify.Op = ^fsnotify.Op(0) ^ fsnotify.Chmod
@@ -52,6 +286,12 @@ func (w *watcher) watch() error {
 	<-timer.C
 	timerStarted := false
 	defer timer.Stop()
+	startTimer := func() {
+		if !timerStarted {
+			timer.Reset(w.delay)
+			timerStarted = true
+		}
+	}
 	for {
 		select {
 		case ev, ok := <-w.w.Events:
@@ -66,62 +306,211 @@ func (w *watcher) watch() error {
 				continue
 			}
 			name := filepath.Clean(ev.Name)
-			if _, ok := w.ignore[name]; ok {
+			if w.ignored(name) {
 				if debugWatch {
 					log.Println("Ignoring change to", name)
 				}
 				continue
 			}
-			if !timerStarted {
-				timer.Reset(w.delay)
-				timerStarted = true
+			w.pending[name] |= ev.Op & chmodMask
+			startTimer()
+			if name == w.configFile {
+				if err := w.reloadConfig(); err != nil {
+					if isWatchLimit(err) {
+						return w.fallBackToPolling(err)
+					}
+					log.Println("Warning: cannot watch project dir:", err)
+				}
+			}
+			if ev.Op&(fsnotify.Remove|fsnotify.Rename) != 0 {
+				// A removed or renamed-away directory tree loses its
+				// watches. (If it was moved elsewhere inside the project,
+				// there is also a Create event for its new name.)
+				w.removeDir(name)
 			}
 			if ev.Op&fsnotify.Create != 0 {
 				stat, err := os.Stat(name)
 				if err != nil {
-					if errors.Is(err, os.ErrNotExist) {
-						continue
+					// The file may already be gone again, as with editor
+					// temp files.
+					if !errors.Is(err, os.ErrNotExist) {
+						log.Println("Warning: cannot stat new file:", err)
 					}
-					return err
+					continue
 				}
 				if stat.IsDir() {
 					if err := w.addDir(name); err != nil {
-						return err
+						if isWatchLimit(err) {
+							return w.fallBackToPolling(err)
+						}
+						log.Println("Warning: cannot watch new directory:", err)
 					}
 				}
 			}
+		case err, ok := <-w.w.Errors:
+			if !ok {
+				return nil
+			}
+			if errors.Is(err, fsnotify.ErrEventOverflow) {
+				// Some events were lost, so rebuild to be safe.
+				log.Println("Warning: too many file changes to track; rebuilding")
+				w.pending[filepath.Clean(w.dir)] |= fsnotify.Write
+				startTimer()
+				continue
+			}
+			log.Println("Warning: error watching for changes:", err)
 		case <-timer.C:
 			if debugWatch {
 				log.Println("Calling watch func")
 			}
-			w.fn()
+			w.flush()
 			timerStarted = false
 		}
 	}
 }
 
 func (w *watcher) addDir(dir string) error {
-	return filepath.Walk(dir, func(name string, info os.FileInfo, err error) error {
+	return walkFollow(dir, func(name string, info os.FileInfo, err error) error {
 		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				return nil // removed while walking
+			}
+			if errors.Is(err, errSymlinkCycle) {
+				log.Println("Warning: not watching", err)
+				return nil
+			}
 			return err
 		}
 		if !info.IsDir() {
 			return nil
 		}
-		if _, ok := w.ignore[name]; ok {
+		if w.ignored(name) {
 			if debugWatch {
 				log.Println("Ignoring dir", name)
 			}
 			return filepath.SkipDir
 		}
+		if _, ok := w.watched[name]; ok {
+			return nil
+		}
 		if debugWatch {
 			log.Println("Adding watch for", name)
 		}
 		if err := w.w.Add(name); err != nil {
-			if !errors.Is(err, os.ErrNotExist) {
-				return err
+			if errors.Is(err, os.ErrNotExist) {
+				return nil
 			}
+			return err
 		}
+		w.watched[name] = struct{}{}
 		return nil
 	})
 }
+
+// removeDir forgets the watches for dir and everything inside it.
+func (w *watcher) removeDir(dir string) {
+	prefix := dir + string(filepath.Separator)
+	for name := range w.watched {
+		if name != dir && !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		if debugWatch {
+			log.Println("Removing watch for", name)
+		}
+		// The watch is usually already gone along with the directory.
+		w.w.Remove(name)
+		delete(w.watched, name)
+	}
+}
+
+// isWatchLimit reports whether err means that the system's limit on
+// watches (or open files) has been reached.
+func isWatchLimit(err error) bool {
+	return errors.Is(err, syscall.ENOSPC) || errors.Is(err, syscall.EMFILE)
+}
+
+func (w *watcher) fallBackToPolling(err error) error {
+	log.Printf("Too many directories to watch for changes (%s); polling every %s instead. "+
+		"On Linux, the limit can be raised with the fs.inotify.max_user_watches sysctl.",
+		err, pollInterval)
+	w.w.Close()
+	return w.poll()
+}
+
+// poll watches for changes by periodically scanning the project.
+func (w *watcher) poll() error {
+	prev := w.scan()
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		cur := w.scan()
+		if changes := diffScans(prev, cur); len(changes) > 0 {
+			if debugWatch {
+				log.Println("Polling found changes:", changes)
+			}
+			if prev[w.configFile] != cur[w.configFile] {
+				w.loadConfig()
+				cur = w.scan()
+			}
+			for _, c := range changes {
+				w.pending[c.name] |= c.op
+			}
+			w.flush()
+		}
+		prev = cur
+	}
+	panic("unreachable")
+}
+
+type fileState struct {
+	size    int64
+	modTime time.Time
+	mode    os.FileMode
+}
+
+func (w *watcher) scan() map[string]fileState {
+	files := make(map[string]fileState)
+	for _, dir := range append([]string{w.dir}, w.roots...) {
+		walkFollow(dir, func(name string, info os.FileInfo, err error) error {
+			if err != nil {
+				// Files may disappear during the scan. Symlink cycles are
+				// skipped.
+				return nil
+			}
+			if w.ignored(name) {
+				if info.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			files[name] = fileState{
+				size:    info.Size(),
+				modTime: info.ModTime(),
+				mode:    info.Mode(),
+			}
+			return nil
+		})
+	}
+	return files
+}
+
+// diffScans returns the files that were created, removed, or modified
+// between two scans.
+func diffScans(prev, cur map[string]fileState) []change {
+	var changes []change
+	for name, st := range cur {
+		prevSt, ok := prev[name]
+		switch {
+		case !ok:
+			changes = append(changes, change{name, fsnotify.Create})
+		case prevSt != st:
+			changes = append(changes, change{name, fsnotify.Write})
+		}
+	}
+	for name := range prev {
+		if _, ok := cur[name]; !ok {
+			changes = append(changes, change{name, fsnotify.Remove})
+		}
+	}
+	return changes
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+func TestDiffScans(t *testing.T) {
+	t0 := time.Date(2018, 3, 5, 0, 0, 0, 0, time.UTC)
+	prev := map[string]fileState{
+		"a": {size: 1, modTime: t0},
+		"b": {size: 2, modTime: t0},
+		"c": {size: 3, modTime: t0},
+	}
+	cur := map[string]fileState{
+		"a": {size: 1, modTime: t0},
+		"b": {size: 2, modTime: t0.Add(time.Second)},
+		"d": {size: 4, modTime: t0},
+	}
+	got := diffScans(prev, cur)
+	sort.Slice(got, func(i, j int) bool { return got[i].name < got[j].name })
+	want := []change{
+		{"b", fsnotify.Write},
+		{"c", fsnotify.Remove},
+		{"d", fsnotify.Create},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v; want %v", got, want)
+	}
+	if got := diffScans(cur, cur); len(got) != 0 {
+		t.Errorf("diffing identical scans: got %q", got)
+	}
+}
+
+func TestWatcherIgnored(t *testing.T) {
+	td := newTempDir(t)
+	defer td.remove()
+	td.writeFile("sitkin/config.json", `{
+  "ignore": ["node_modules", "drafts/*.md", "*.md", "src", "posts"],
+  "filesets": ["posts"],
+  "bundles": {"/site.css": ["src/css/a.css"]}
+}`)
+
+	w := &watcher{
+		dir:        td.dir,
+		configFile: td.path("sitkin/config.json"),
+		ignoreTop:  map[string]struct{}{"gen": {}},
+	}
+	w.loadConfig()
+	for _, tt := range []struct {
+		name string
+		want bool
+	}{
+		{"", false},
+		{"index.tmpl", false},
+		{"sitkin/config.json", false},
+		{"assets/.hidden/x.css", false},
+		{"gen", true},
+		{"gen/index.html", true},
+		{".git/index", true},
+		{".sitkin-cache/cache.json", true},
+		{"node_modules", true},
+		{"node_modules/x/y.js", true},
+		{"drafts/a.md", true},
+		{"drafts/a.txt", false},
+		{"about.md", false},
+		{"posts", false},
+		{"posts/2018-03-05.a.md", false},
+		{"src", false},
+		{"src/css", false},
+		{"src/css/a.css", false},
+		{"src/css/b.css", true},
+		{"src/x.js", true},
+		{"posts/.hello.md.swp", true},
+		{"posts/hello.md~", true},
+		{"posts/.#hello.md", true},
+		{"posts/#hello.md#", true},
+		{"sitkin/4913", true},
+		{"assets/.DS_Store", true},
+	} {
+		if got := w.ignored(td.path(tt.name)); got != tt.want {
+			t.Errorf("ignored(%q): got %t; want %t", tt.name, got, tt.want)
+		}
+	}
+
+	td.writeFile("sitkin/config.json", `{"ignore": ["drafts"], "watch": ["../shared"]}`)
+	w.loadConfig()
+	if w.ignored(td.path("node_modules/x.js")) || !w.ignored(td.path("drafts/a.txt")) {
+		t.Errorf("ignore globs not reloaded: got %q", w.ignoreGlobs)
+	}
+	shared := filepath.Join(filepath.Dir(td.dir), "shared")
+	if want := []string{shared}; !reflect.DeepEqual(w.roots, want) {
+		t.Errorf("got roots %q; want %q", w.roots, want)
+	}
+	if w.ignored(filepath.Join(shared, "drafts/x.tmpl")) || !w.ignored(filepath.Join(shared, ".x.tmpl.swp")) {
+		t.Error("wrong ignore rules outside the project dir")
+	}
+}
+
+func TestNeedsFullReload(t *testing.T) {
+	for _, tt := range []struct {
+		changes []change
+		want    bool
+	}{
+		{nil, false},
+		{[]change{{"site/posts/a.md", fsnotify.Write}, {"site/x.css", fsnotify.Create}}, false},
+		{[]change{{"site/sitkinx.md", fsnotify.Write}}, false},
+		{[]change{{"site/posts/a.md", fsnotify.Write}, {"site/sitkin/default.tmpl", fsnotify.Write}}, true},
+		{[]change{{"site/sitkin", fsnotify.Remove}}, true},
+		{[]change{{"site", fsnotify.Write}}, true},
+		{[]change{{"shared/x.tmpl", fsnotify.Write}}, true},
+	} {
+		if got := needsFullReload("site/", tt.changes); got != tt.want {
+			t.Errorf("needsFullReload(%v): got %t; want %t", tt.changes, got, tt.want)
+		}
+	}
+}
+
+// startWatcher watches dir (whose config must exist) using fsnotify. The
+// returned stop function waits for the watcher to stop.
+func startWatcher(t *testing.T, dir string) (w *watcher, changes <-chan []change, stop func()) {
+	t.Helper()
+	ch := make(chan []change, 100)
+	w = newWatcher(dir, "", 10*time.Millisecond, func(c []change) {
+		select {
+		case ch <- c:
+		default:
+			t.Error("too many changes")
+		}
+	}, "gen")
+	fw, err := fsnotify.NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.w = fw
+	if err := w.addDir(dir); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error)
+	go func() { done <- w.watch() }()
+	stop = func() {
+		fw.Close()
+		if err := <-done; err != nil {
+			t.Error("watch failed:", err)
+		}
+	}
+	return w, ch, stop
+}
+
+// waitForChange waits until the watcher reports a change to name and
+// returns all the changes seen until then.
+func waitForChange(t *testing.T, changes <-chan []change, name string) []change {
+	t.Helper()
+	var seen []change
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case cs := <-changes:
+			seen = append(seen, cs...)
+			for _, c := range cs {
+				if c.name == name {
+					return seen
+				}
+			}
+		case <-timeout:
+			t.Fatalf("no change to %s reported; got %v", name, seen)
+		}
+	}
+}
+
+func TestWatchIgnoredBundleSource(t *testing.T) {
+	td := newTempDir(t)
+	defer td.remove()
+	td.writeFile("sitkin/config.json", `{"ignore": ["src"], "bundles": {"/site.css": ["src/a.css"]}}`)
+	td.writeFile("src/a.css", "a{}")
+	td.writeFile("src/b.css", "b{}")
+
+	_, changes, stop := startWatcher(t, td.dir)
+	defer stop()
+
+	td.writeFile("src/b.css", "b{color:red}")
+	td.writeFile("src/a.css", "a{color:red}")
+	for _, c := range waitForChange(t, changes, td.path("src/a.css")) {
+		if c.name == td.path("src/b.css") {
+			t.Errorf("got change to ignored file: %s", c)
+		}
+	}
+}
+
+func TestWatchRenamedDir(t *testing.T) {
+	td := newTempDir(t)
+	defer td.remove()
+	td.writeFile("sitkin/config.json", `{}`)
+	td.writeFile("assets/old/a.css", "a{}")
+
+	w, changes, stop := startWatcher(t, td.dir)
+	stopped := false
+	defer func() {
+		if !stopped {
+			stop()
+		}
+	}()
+
+	// Files written into a renamed dir are seen at the new name.
+	if err := os.Rename(td.path("assets/old"), td.path("assets/new")); err != nil {
+		t.Fatal(err)
+	}
+	waitForChange(t, changes, td.path("assets/new"))
+	td.writeFile("assets/new/b.css", "b{}")
+	waitForChange(t, changes, td.path("assets/new/b.css"))
+
+	// A dir that is removed and created again at the same path is
+	// watched again.
+	if err := os.RemoveAll(td.path("assets/new")); err != nil {
+		t.Fatal(err)
+	}
+	waitForChange(t, changes, td.path("assets/new"))
+	if err := os.Mkdir(td.path("assets/new"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	waitForChange(t, changes, td.path("assets/new"))
+	td.writeFile("assets/new/c.css", "c{}")
+	waitForChange(t, changes, td.path("assets/new/c.css"))
+
+	stop()
+	stopped = true
+	if _, ok := w.watched[td.path("assets/old")]; ok {
+		t.Error("the renamed dir is still watched at its old name")
+	}
+	if _, ok := w.watched[td.path("assets/new")]; !ok {
+		t.Error("the recreated dir is not watched")
+	}
+}
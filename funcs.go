@@ -0,0 +1,465 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"html/template"
+	"math"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// builtinFuncs are the template functions that don't depend on the site.
+// They are available in both HTML and text templates.
+//
+// The functions that operate on lists take the list as their last argument
+// so that they can be used in pipelines:
+//
+//	{{range .FileSets.posts.Files | where "Metadata.tag" "go" | first 5}}
+var builtinFuncs = template.FuncMap{
+	"formatRFC3339": func(t time.Time) string { return t.Format(time.RFC3339) },
+	"formatDate":    func(layout string, t time.Time) string { return t.Format(layout) },
+	"xmlEscape": func(b template.HTML) (string, error) {
+		var buf strings.Builder
+		if err := xml.EscapeText(&buf, []byte(b)); err != nil {
+			return "", err
+		}
+		return buf.String(), nil
+	},
+
+	"sortBy":  sortBy,
+	"groupBy": groupBy,
+	"where":   where,
+	"first":   first,
+	"last":    last,
+
+	"markdownify": func(s string) template.HTML { return template.HTML(renderMarkdown([]byte(s))) },
+	"truncate":    truncate,
+	"slugify":     slugify,
+	"jsonify":     jsonify,
+
+	"dict": dict,
+	"list": func(vs ...interface{}) []interface{} { return vs },
+
+	"add": func(a, b interface{}) (interface{}, error) { return arith("add", a, b) },
+	"sub": func(a, b interface{}) (interface{}, error) { return arith("sub", a, b) },
+	"mul": func(a, b interface{}) (interface{}, error) { return arith("mul", a, b) },
+	"div": func(a, b interface{}) (interface{}, error) { return arith("div", a, b) },
+	"mod": func(a, b interface{}) (interface{}, error) { return arith("mod", a, b) },
+}
+
+// lookupPath evaluates path, a dot-separated list of field names, map keys,
+// and methods without arguments, starting from v. For example,
+// lookupPath(md, "Date.Year") is like the template expression .Date.Year.
+// A missing map key gives nil.
+func lookupPath(v interface{}, path string) (interface{}, error) {
+	rv := reflect.ValueOf(v)
+	for _, name := range strings.Split(path, ".") {
+		if !rv.IsValid() {
+			return nil, nil
+		}
+		if m, ok := niladicMethod(rv, name); ok {
+			rv = m.Call(nil)[0]
+			continue
+		}
+		rv = indirect(rv)
+		if !rv.IsValid() {
+			return nil, nil
+		}
+		if m, ok := niladicMethod(rv, name); ok {
+			rv = m.Call(nil)[0]
+			continue
+		}
+		switch rv.Kind() {
+		case reflect.Struct:
+			sf, ok := rv.Type().FieldByName(name)
+			if !ok || !sf.IsExported() {
+				return nil, fmt.Errorf("%s has no field %s", rv.Type(), name)
+			}
+			rv = rv.FieldByIndex(sf.Index)
+		case reflect.Map:
+			if rv.Type().Key().Kind() != reflect.String {
+				return nil, fmt.Errorf("cannot look up %s in %s", name, rv.Type())
+			}
+			rv = rv.MapIndex(reflect.ValueOf(name).Convert(rv.Type().Key()))
+		default:
+			return nil, fmt.Errorf("cannot look up %s in %s", name, rv.Type())
+		}
+	}
+	rv = indirect(rv)
+	if !rv.IsValid() {
+		return nil, nil
+	}
+	return rv.Interface(), nil
+}
+
+func niladicMethod(rv reflect.Value, name string) (reflect.Value, bool) {
+	if rv.Kind() == reflect.Interface {
+		return reflect.Value{}, false
+	}
+	m := rv.MethodByName(name)
+	if !m.IsValid() || m.Type().NumIn() != 0 || m.Type().NumOut() != 1 {
+		return reflect.Value{}, false
+	}
+	return m, true
+}
+
+// indirect follows pointers and interfaces. It returns the zero Value for
+// nil.
+func indirect(rv reflect.Value) reflect.Value {
+	for rv.IsValid() && (rv.Kind() == reflect.Pointer || rv.Kind() == reflect.Interface) {
+		if rv.IsNil() {
+			return reflect.Value{}
+		}
+		rv = rv.Elem()
+	}
+	return rv
+}
+
+// listValue returns the slice or array list as a reflect.Value.
+func listValue(list interface{}) (reflect.Value, error) {
+	rv := indirect(reflect.ValueOf(list))
+	switch rv.Kind() {
+	case reflect.Slice, reflect.Array:
+		return rv, nil
+	case reflect.Invalid:
+		return reflect.ValueOf([]interface{}{}), nil
+	default:
+		return reflect.Value{}, fmt.Errorf("%T is not a list", list)
+	}
+}
+
+// sortBy returns a copy of list sorted by the value at key (see
+// lookupPath) in each element. If the optional order argument is "desc",
+// the list is sorted in descending order.
+func sortBy(key string, args ...interface{}) (interface{}, error) {
+	var order string
+	switch len(args) {
+	case 1:
+	case 2:
+		o, ok := args[0].(string)
+		if !ok || (o != "asc" && o != "desc") {
+			return nil, fmt.Errorf("sortBy order must be asc or desc, not %v", args[0])
+		}
+		order = o
+		args = args[1:]
+	default:
+		return nil, errors.New("usage: sortBy key [order] list")
+	}
+	rv, err := listValue(args[0])
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]interface{}, rv.Len())
+	for i := range keys {
+		if keys[i], err = lookupPath(rv.Index(i).Interface(), key); err != nil {
+			return nil, err
+		}
+	}
+	idx := make([]int, rv.Len())
+	for i := range idx {
+		idx[i] = i
+	}
+	var cmpErr error
+	sort.SliceStable(idx, func(i, j int) bool {
+		c, err := compareValues(keys[idx[i]], keys[idx[j]])
+		if err != nil && cmpErr == nil {
+			cmpErr = err
+		}
+		if order == "desc" {
+			return c > 0
+		}
+		return c < 0
+	})
+	if cmpErr != nil {
+		return nil, fmt.Errorf("cannot sort by %s: %s", key, cmpErr)
+	}
+	sorted := reflect.MakeSlice(reflect.SliceOf(rv.Type().Elem()), rv.Len(), rv.Len())
+	for i, j := range idx {
+		sorted.Index(i).Set(rv.Index(j))
+	}
+	return sorted.Interface(), nil
+}
+
+// A group is an element of the result of groupBy.
+type group struct {
+	Key   interface{}
+	Items interface{} // a list of the same type as the grouped list
+}
+
+// groupBy groups the elements of list by the value at key (see lookupPath).
+// The groups are in the order of their first elements in list.
+func groupBy(key string, list interface{}) ([]group, error) {
+	rv, err := listValue(list)
+	if err != nil {
+		return nil, err
+	}
+	var groups []group
+	var items []reflect.Value
+	index := make(map[interface{}]int)
+	for i := 0; i < rv.Len(); i++ {
+		k, err := lookupPath(rv.Index(i).Interface(), key)
+		if err != nil {
+			return nil, err
+		}
+		if k != nil && !reflect.TypeOf(k).Comparable() {
+			return nil, fmt.Errorf("cannot group by %s (%T values)", key, k)
+		}
+		j, ok := index[k]
+		if !ok {
+			j = len(groups)
+			index[k] = j
+			groups = append(groups, group{Key: k})
+			items = append(items, reflect.MakeSlice(reflect.SliceOf(rv.Type().Elem()), 0, 1))
+		}
+		items[j] = reflect.Append(items[j], rv.Index(i))
+	}
+	for i := range groups {
+		groups[i].Items = items[i].Interface()
+	}
+	return groups, nil
+}
+
+// where returns the elements of list whose value at key (see lookupPath)
+// equals value.
+func where(key string, value, list interface{}) (interface{}, error) {
+	rv, err := listValue(list)
+	if err != nil {
+		return nil, err
+	}
+	matches := reflect.MakeSlice(reflect.SliceOf(rv.Type().Elem()), 0, 0)
+	for i := 0; i < rv.Len(); i++ {
+		v, err := lookupPath(rv.Index(i).Interface(), key)
+		if err != nil {
+			return nil, err
+		}
+		if valuesEqual(v, value) {
+			matches = reflect.Append(matches, rv.Index(i))
+		}
+	}
+	return matches.Interface(), nil
+}
+
+// first returns the first n elements of list (or all of them, if there are
+// fewer than n).
+func first(n int, list interface{}) (interface{}, error) {
+	rv, err := listValue(list)
+	if err != nil {
+		return nil, err
+	}
+	if n < 0 {
+		return nil, fmt.Errorf("first: negative count %d", n)
+	}
+	if n > rv.Len() {
+		n = rv.Len()
+	}
+	return rv.Slice(0, n).Interface(), nil
+}
+
+// last returns the last n elements of list (or all of them, if there are
+// fewer than n).
+func last(n int, list interface{}) (interface{}, error) {
+	rv, err := listValue(list)
+	if err != nil {
+		return nil, err
+	}
+	if n < 0 {
+		return nil, fmt.Errorf("last: negative count %d", n)
+	}
+	if n > rv.Len() {
+		n = rv.Len()
+	}
+	return rv.Slice(rv.Len()-n, rv.Len()).Interface(), nil
+}
+
+// toFloat converts numbers of any type to float64.
+func toFloat(v interface{}) (float64, bool) {
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(rv.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return float64(rv.Uint()), true
+	case reflect.Float32, reflect.Float64:
+		return rv.Float(), true
+	default:
+		return 0, false
+	}
+}
+
+// toInt converts integers of any type (including float64 values without a
+// fractional part, as decoded from JSON) to int.
+func toInt(v interface{}) (int, bool) {
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return int(rv.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return int(rv.Uint()), true
+	case reflect.Float32, reflect.Float64:
+		f := rv.Float()
+		if f != math.Trunc(f) || math.Abs(f) > 1<<53 {
+			return 0, false
+		}
+		return int(f), true
+	default:
+		return 0, false
+	}
+}
+
+// compareValues compares numbers (of any type), strings, times, and
+// booleans. Nil sorts before everything else.
+func compareValues(a, b interface{}) (int, error) {
+	switch {
+	case a == nil && b == nil:
+		return 0, nil
+	case a == nil:
+		return -1, nil
+	case b == nil:
+		return 1, nil
+	}
+	if af, ok := toFloat(a); ok {
+		if bf, ok := toFloat(b); ok {
+			switch {
+			case af < bf:
+				return -1, nil
+			case af > bf:
+				return 1, nil
+			default:
+				return 0, nil
+			}
+		}
+	}
+	switch a := a.(type) {
+	case string:
+		if b, ok := b.(string); ok {
+			return strings.Compare(a, b), nil
+		}
+	case time.Time:
+		if b, ok := b.(time.Time); ok {
+			return a.Compare(b), nil
+		}
+	case bool:
+		if b, ok := b.(bool); ok {
+			switch {
+			case a == b:
+				return 0, nil
+			case b:
+				return -1, nil
+			default:
+				return 1, nil
+			}
+		}
+	}
+	return 0, fmt.Errorf("cannot compare %T and %T", a, b)
+}
+
+func valuesEqual(a, b interface{}) bool {
+	if c, err := compareValues(a, b); err == nil {
+		return c == 0
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// truncate shortens s to at most n characters, ending it with an ellipsis
+// (and cutting at a word boundary, if possible) if anything was removed.
+func truncate(n int, s string) string {
+	if utf8.RuneCountInString(s) <= n {
+		return s
+	}
+	if n <= 0 {
+		return ""
+	}
+	runes := []rune(s)
+	t := string(runes[:n-1])
+	// Don't leave part of a word at the end.
+	if !unicode.IsSpace(runes[n-1]) {
+		if i := strings.LastIndexAny(t, " \t\n"); i > 0 {
+			t = t[:i]
+		}
+	}
+	return strings.TrimRight(t, " \t\n.,;:") + "…"
+}
+
+// jsonify encodes v as JSON. The result may be used directly inside a
+// <script> element.
+func jsonify(v interface{}) (template.JS, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	return template.JS(b), nil
+}
+
+// dict makes a map from alternating keys and values.
+func dict(kvs ...interface{}) (map[string]interface{}, error) {
+	if len(kvs)%2 != 0 {
+		return nil, errors.New("dict needs an even number of arguments")
+	}
+	m := make(map[string]interface{}, len(kvs)/2)
+	for i := 0; i < len(kvs); i += 2 {
+		k, ok := kvs[i].(string)
+		if !ok {
+			return nil, fmt.Errorf("dict key %v is not a string", kvs[i])
+		}
+		m[k] = kvs[i+1]
+	}
+	return m, nil
+}
+
+// arith does integer arithmetic if a and b are both integers and floating
+// point arithmetic otherwise.
+func arith(op string, a, b interface{}) (interface{}, error) {
+	ai, aInt := toInt(a)
+	bi, bInt := toInt(b)
+	if aInt && bInt && !isFloat(a) && !isFloat(b) {
+		switch op {
+		case "add":
+			return ai + bi, nil
+		case "sub":
+			return ai - bi, nil
+		case "mul":
+			return ai * bi, nil
+		case "div", "mod":
+			if bi == 0 {
+				return nil, fmt.Errorf("%s: division by zero", op)
+			}
+			if op == "div" {
+				return ai / bi, nil
+			}
+			return ai % bi, nil
+		}
+	}
+	af, ok := toFloat(a)
+	if !ok {
+		return nil, fmt.Errorf("%s: %v is not a number", op, a)
+	}
+	bf, ok := toFloat(b)
+	if !ok {
+		return nil, fmt.Errorf("%s: %v is not a number", op, b)
+	}
+	switch op {
+	case "add":
+		return af + bf, nil
+	case "sub":
+		return af - bf, nil
+	case "mul":
+		return af * bf, nil
+	case "div":
+		return af / bf, nil
+	case "mod":
+		return math.Mod(af, bf), nil
+	}
+	panic("unknown op " + op)
+}
+
+func isFloat(v interface{}) bool {
+	k := reflect.ValueOf(v).Kind()
+	return k == reflect.Float32 || k == reflect.Float64
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"html/template"
+	"strings"
+	"testing"
+	texttemplate "text/template"
+	"time"
+)
+
+func TestBuiltinFuncs(t *testing.T) {
+	date := func(s string) time.Time {
+		d, err := time.Parse("2006-01-02", s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+	files := []*markdownFile{
+		{Name: "b", Date: date("2018-03-05"), Metadata: map[string]interface{}{"tag": "go", "rating": 2.0}},
+		{Name: "a", Date: date("2017-01-02"), Metadata: map[string]interface{}{"tag": "rust", "rating": 3.0}},
+		{Name: "c", Date: date("2018-11-20"), Metadata: map[string]interface{}{"tag": "go"}},
+	}
+	data := map[string]interface{}{
+		"Files": files,
+		"Date":  date("2018-03-05"),
+		"Text":  "The quick brown fox jumps over the lazy dog",
+	}
+	for _, tt := range []struct {
+		tmpl string
+		want string
+	}{
+		{`{{formatDate "Jan 2, 2006" .Date}}`, "Mar 5, 2018"},
+		{`{{range sortBy "Name" .Files}}{{.Name}}{{end}}`, "abc"},
+		{`{{range .Files | sortBy "Date" "desc"}}{{.Name}}{{end}}`, "cba"},
+		{`{{range sortBy "Metadata.rating" .Files}}{{.Name}}{{end}}`, "cba"},
+		{`{{range groupBy "Date.Year" .Files}}{{.Key}}:{{range .Items}}{{.Name}}{{end}} {{end}}`, "2018:bc 2017:a "},
+		{`{{range where "Metadata.tag" "go" .Files}}{{.Name}}{{end}}`, "bc"},
+		{`{{range where "Metadata.rating" 3 .Files}}{{.Name}}{{end}}`, "a"},
+		{`{{range .Files | first 2}}{{.Name}}{{end}}`, "ba"},
+		{`{{range .Files | last 2}}{{.Name}}{{end}}`, "ac"},
+		{`{{range .Files | first 10}}{{.Name}}{{end}}`, "bac"},
+		{`{{markdownify "*hi*"}}`, "<p><em>hi</em></p>\n"},
+		{`{{truncate 20 .Text}}`, "The quick brown fox…"},
+		{`{{truncate 18 .Text}}`, "The quick brown…"},
+		{`{{truncate 100 .Text}}`, "The quick brown fox jumps over the lazy dog"},
+		{`{{slugify "Hello, World!"}}`, "hello-world"},
+		{`{{with dict "a" 1 "b" "x"}}{{.a}}{{.b}}{{end}}`, "1x"},
+		{`{{range list 1 "a" true}}{{.}}{{end}}`, "1atrue"},
+		{`{{add 1 2}} {{sub 1 2}} {{mul 3 4}} {{div 7 2}} {{mod 7 2}}`, "3 -1 12 3 1"},
+		{`{{add 1 0.5}} {{div 7.0 2}}`, "1.5 3.5"},
+		{`<script>var x = {{jsonify (dict "a" (list 1 2))}};</script>`, `<script>var x = {"a":[1,2]};</script>`},
+	} {
+		tmpl, err := template.New("").Funcs(builtinFuncs).Parse(tt.tmpl)
+		if err != nil {
+			t.Errorf("%s: parse error: %s", tt.tmpl, err)
+			continue
+		}
+		var buf strings.Builder
+		if err := tmpl.Execute(&buf, data); err != nil {
+			t.Errorf("%s: execute error: %s", tt.tmpl, err)
+			continue
+		}
+		if got := buf.String(); got != tt.want {
+			t.Errorf("%s: got %q; want %q", tt.tmpl, got, tt.want)
+		}
+	}
+}
+
+func TestBuiltinFuncsText(t *testing.T) {
+	tmpl, err := texttemplate.New("").Funcs(texttemplate.FuncMap(builtinFuncs)).Parse(
+		`{{jsonify (dict "a" "<b>")}} {{range sortBy "x" (list (dict "x" 2) (dict "x" 1))}}{{.x}}{{end}}`,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf strings.Builder
+	if err := tmpl.Execute(&buf, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := buf.String(), `{"a":"\u003cb\u003e"} 12`; got != want {
+		t.Errorf("got %q; want %q", got, want)
+	}
+}
+
+func TestBuiltinFuncErrors(t *testing.T) {
+	for _, tt := range []struct {
+		tmpl    string
+		wantErr string
+	}{
+		{`{{sortBy "Nope" .}}`, "has no field Nope"},
+		{`{{sortBy "x" (list (dict "x" 1) (dict "x" "a"))}}`, "cannot compare"},
+		{`{{first 1 3}}`, "int is not a list"},
+		{`{{dict "a"}}`, "even number of arguments"},
+		{`{{div 1 0}}`, "division by zero"},
+		{`{{add 1 "x"}}`, "x is not a number"},
+	} {
+		tmpl, err := template.New("").Funcs(builtinFuncs).Parse(tt.tmpl)
+		if err != nil {
+			t.Errorf("%s: parse error: %s", tt.tmpl, err)
+			continue
+		}
+		err = tmpl.Execute(new(strings.Builder), []*markdownFile{{Name: "a"}})
+		if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("%s: got err %v; want %q", tt.tmpl, err, tt.wantErr)
+		}
+	}
+}
@@ -1,17 +1,20 @@
 module github.com/cespare/sitkin
 
 require (
+	github.com/andybalholm/brotli v1.1.0
 	github.com/fsnotify/fsnotify v1.7.0
 	github.com/kr/pretty v0.3.1
 	github.com/tdewolff/minify/v2 v2.20.37
 	github.com/yuin/goldmark v1.7.4
+	golang.org/x/image v0.23.0
+	golang.org/x/sys v0.16.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
 	github.com/kr/text v0.2.0 // indirect
 	github.com/rogpeppe/go-internal v1.9.0 // indirect
 	github.com/tdewolff/parse/v2 v2.7.15 // indirect
-	golang.org/x/sys v0.16.0 // indirect
 )
 
 go 1.23
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"html/template"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"math"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/image/draw"
+)
+
+// imageConfig configures the responsive image pipeline for the asset files
+// matching a set of globs.
+type imageConfig struct {
+	Match   []string
+	Widths  []int
+	Sizes   string
+	Quality int
+}
+
+const (
+	defaultImageQuality = 85
+	defaultImageSizes   = "100vw"
+)
+
+// imageAsset is a copied image file for which sitkin generates resized
+// variants.
+type imageAsset struct {
+	srcPath     string // relative to source dir
+	href        string // link to the full-size (possibly hashed) image
+	format      string // "jpeg" or "png"
+	orientation int    // EXIF orientation (JPEG only)
+	width       int    // as displayed, after applying the orientation
+	height      int
+	sizes       string
+	quality     int
+	variants    []*imageVariant // ordered by increasing width
+}
+
+type imageVariant struct {
+	dstPath string // relative to dst dir
+	width   int
+	height  int
+}
+
+func (c *imageConfig) check() error {
+	for _, glob := range c.Match {
+		if _, err := path.Match(glob, ""); err != nil {
+			return fmt.Errorf("bad image glob %q: %s", glob, err)
+		}
+	}
+	if len(c.Widths) == 0 {
+		return errors.New("image config has no widths")
+	}
+	for _, w := range c.Widths {
+		if w <= 0 {
+			return fmt.Errorf("bad image width %d", w)
+		}
+	}
+	if c.Quality < 0 || c.Quality > 100 {
+		return fmt.Errorf("bad image quality %d", c.Quality)
+	}
+	return nil
+}
+
+func (c *imageConfig) matches(relpath string) bool {
+	for _, glob := range c.Match {
+		match, err := path.Match(glob, filepath.ToSlash(relpath))
+		if err != nil {
+			panic(err) // already checked
+		}
+		if match {
+			return true
+		}
+	}
+	return false
+}
+
+// loadImages finds the copied files that are configured as images and
+// records the variants that will be generated for each of them.
+func (s *sitkin) loadImages() error {
+	for _, cf := range s.copyFiles {
+		for i := range s.config.Images {
+			c := &s.config.Images[i]
+			if !c.matches(cf.srcPath) {
+				continue
+			}
+			img, err := s.loadImage(cf, c)
+			if err != nil {
+				return fmt.Errorf("error loading image %s: %s", cf.srcPath, err)
+			}
+			s.images["/"+filepath.ToSlash(cf.srcPath)] = img
+			break
+		}
+	}
+	return nil
+}
+
+func (s *sitkin) loadImage(cf *copyFile, c *imageConfig) (*imageAsset, error) {
+	src := filepath.Join(s.dir, cf.srcPath)
+	f, err := os.Open(src)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	cfg, format, err := image.DecodeConfig(f)
+	if err != nil {
+		return nil, err
+	}
+	orientation := 1
+	switch format {
+	case "jpeg":
+		// Phone cameras often store portrait photos sideways and set
+		// the EXIF orientation, which the decoder doesn't apply and the
+		// resized variants would lose.
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+		orientation, err = jpegOrientation(f)
+		if err != nil {
+			return nil, err
+		}
+	case "png":
+	default:
+		return nil, fmt.Errorf("unsupported image format %q", format)
+	}
+	img := &imageAsset{
+		srcPath:     cf.srcPath,
+		href:        "/" + filepath.ToSlash(cf.dstPath),
+		format:      format,
+		orientation: orientation,
+		width:       cfg.Width,
+		height:      cfg.Height,
+		sizes:       c.Sizes,
+		quality:     c.Quality,
+	}
+	if orientationSwapsAxes(orientation) {
+		img.width, img.height = img.height, img.width
+	}
+	if img.sizes == "" {
+		img.sizes = defaultImageSizes
+	}
+	if img.quality == 0 {
+		img.quality = defaultImageQuality
+	}
+
+	widths := append([]int(nil), c.Widths...)
+	sort.Ints(widths)
+	var srcHash string
+	if !s.devMode {
+		srcHash, err = s.cache.fileHash(src)
+		if err != nil {
+			return nil, err
+		}
+	}
+	ext := path.Ext(filepath.Base(cf.srcPath))
+	base := strings.TrimSuffix(cf.srcPath, ext)
+	for i, w := range widths {
+		// Never scale up; the full-size image covers the largest width.
+		if w >= img.width || (i > 0 && w == widths[i-1]) {
+			continue
+		}
+		h := "NOHASH"
+		if !s.devMode {
+			h = imageVariantHash(srcHash, w, img.quality)
+		}
+		img.variants = append(img.variants, &imageVariant{
+			dstPath: base + ".w" + strconv.Itoa(w) + "." + h + ext,
+			width:   w,
+			height:  scaledHeight(img.width, img.height, w),
+		})
+	}
+	return img, nil
+}
+
+// imageVariantHash derives the name hash of a resized variant from the hash
+// of the source image and the parameters that determine the variant's
+// contents.
+func imageVariantHash(srcHash string, width, quality int) string {
+	h := sha256.Sum256([]byte(fmt.Sprintf("%s:%d:%d", srcHash, width, quality)))
+	return base62Hash(h[:8])
+}
+
+func scaledHeight(width, height, w int) int {
+	h := int(math.Round(float64(height) * float64(w) / float64(width)))
+	if h < 1 {
+		h = 1
+	}
+	return h
+}
+
+// renderImage writes the resized variants of img to dstDir, skipping any
+// hashed variants which already exist (or, in dev mode, any variants which
+// are newer than the source image).
+func (s *sitkin) renderImage(img *imageAsset, dstDir string) error {
+	var srcModTime time.Time
+	if s.devMode {
+		fi, err := os.Stat(filepath.Join(s.dir, img.srcPath))
+		if err != nil {
+			return err
+		}
+		srcModTime = fi.ModTime()
+	}
+	var variants []*imageVariant
+	for _, v := range img.variants {
+		dst := filepath.Join(dstDir, v.dstPath)
+		if err := s.addOutput(dst); err != nil {
+			return err
+		}
+		fi, err := os.Stat(dst)
+		if err == nil {
+			if !s.devMode {
+				// A variant's name changes with its contents.
+				continue
+			}
+			if fi.ModTime().After(srcModTime) {
+				continue
+			}
+		}
+		variants = append(variants, v)
+	}
+	return img.render(s.dir, dstDir, variants)
+}
+
+// render writes the given resized variants of img to dstDir.
+func (img *imageAsset) render(srcDir, dstDir string, variants []*imageVariant) error {
+	if len(variants) == 0 {
+		return nil
+	}
+	f, err := os.Open(filepath.Join(srcDir, img.srcPath))
+	if err != nil {
+		return err
+	}
+	src, _, err := image.Decode(f)
+	f.Close()
+	if err != nil {
+		return err
+	}
+	src = applyOrientation(src, img.orientation)
+	for _, v := range variants {
+		dst := image.NewNRGBA(image.Rect(0, 0, v.width, v.height))
+		draw.CatmullRom.Scale(dst, dst.Bounds(), src, src.Bounds(), draw.Src, nil)
+		write := func(w io.Writer) error {
+			if img.format == "png" {
+				return png.Encode(w, dst)
+			}
+			return jpeg.Encode(w, dst, &jpeg.Options{Quality: img.quality})
+		}
+		if err := writeFileAtomic(filepath.Join(dstDir, v.dstPath), 0o644, write); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// img is the template function that renders a responsive <img> element for
+// a configured image.
+func (s *sitkin) img(src string, alt ...string) (template.HTML, error) {
+	img, ok := s.images[src]
+	if !ok {
+		return "", fmt.Errorf("img: %s is not a configured image", src)
+	}
+	if len(alt) > 1 {
+		return "", errors.New("img: too many arguments")
+	}
+	var srcset []string
+	for _, v := range img.variants {
+		srcset = append(srcset, fmt.Sprintf("/%s %dw", filepath.ToSlash(v.dstPath), v.width))
+	}
+	srcset = append(srcset, fmt.Sprintf("%s %dw", img.href, img.width))
+	var b strings.Builder
+	fmt.Fprintf(&b, `<img src="%s" srcset="%s" sizes="%s" width="%d" height="%d"`,
+		template.HTMLEscapeString(img.href),
+		template.HTMLEscapeString(strings.Join(srcset, ", ")),
+		template.HTMLEscapeString(img.sizes),
+		img.width, img.height)
+	if len(alt) > 0 {
+		fmt.Fprintf(&b, ` alt="%s"`, template.HTMLEscapeString(alt[0]))
+	}
+	b.WriteString(">")
+	return template.HTML(b.String()), nil
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestImages(t *testing.T) {
+	td := newTempDir(t)
+	defer td.remove()
+
+	td.writeFile(
+		"sitkin/config.json",
+		`{
+  "images": [
+    {
+      "match": ["photos/*.png"],
+      "widths": [20, 50, 200],
+      "sizes": "50vw"
+    }
+  ]
+}`,
+	)
+	td.writeFile("sitkin/default.tmpl", `{{block "contents" .}}{{end}}`)
+	td.writeFile(
+		"index.tmpl",
+		`{{define "contents"}}{{img "/photos/a.png" "A & B"}}{{end}}`,
+	)
+	m := image.NewNRGBA(image.Rect(0, 0, 100, 50))
+	for x := 0; x < 100; x++ {
+		for y := 0; y < 50; y++ {
+			m.Set(x, y, color.NRGBA{uint8(x), uint8(y), 0, 255})
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, m); err != nil {
+		t.Fatal(err)
+	}
+	td.writeFile("photos/a.png", buf.String())
+
+	s, err := load(td.dir, options{})
+	if err != nil {
+		t.Fatal("load failed:", err)
+	}
+	if err := s.render(context.Background()); err != nil {
+		t.Fatal("render failed:", err)
+	}
+
+	h := hashBase62(buf.String())
+	full := "/photos/a." + h + ".png"
+	w20 := "/photos/a.w20." + imageVariantHash(h, 20, defaultImageQuality) + ".png"
+	w50 := "/photos/a.w50." + imageVariantHash(h, 50, defaultImageQuality) + ".png"
+	td.checkFile(
+		"gen/index.html",
+		`<img src=`+full+` srcset="`+w20+` 20w, `+w50+` 50w, `+full+` 100w" sizes=50vw width=100 height=50 alt="A & B">`,
+	)
+	for _, tt := range []struct {
+		name string
+		w, h int
+	}{
+		{full, 100, 50},
+		{w20, 20, 10},
+		{w50, 50, 25},
+	} {
+		f, err := os.Open(td.path("gen" + tt.name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg, err := png.DecodeConfig(f)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cfg.Width != tt.w || cfg.Height != tt.h {
+			t.Errorf("%s: got %dx%d; want %dx%d", tt.name, cfg.Width, cfg.Height, tt.w, tt.h)
+		}
+	}
+}
+
+func TestApplyOrientation(t *testing.T) {
+	src := image.NewNRGBA(image.Rect(0, 0, 3, 2))
+	for x := 0; x < 3; x++ {
+		for y := 0; y < 2; y++ {
+			src.Set(x, y, color.NRGBA{uint8(x), uint8(y), 0, 255})
+		}
+	}
+	for _, tt := range []struct {
+		o      int
+		w, h   int
+		origin image.Point // source of the pixel at (0, 0)
+		next   image.Point // source of the pixel at (1, 0)
+	}{
+		{1, 3, 2, image.Pt(0, 0), image.Pt(1, 0)},
+		{2, 3, 2, image.Pt(2, 0), image.Pt(1, 0)},
+		{3, 3, 2, image.Pt(2, 1), image.Pt(1, 1)},
+		{4, 3, 2, image.Pt(0, 1), image.Pt(1, 1)},
+		{5, 2, 3, image.Pt(0, 0), image.Pt(0, 1)},
+		{6, 2, 3, image.Pt(0, 1), image.Pt(0, 0)},
+		{7, 2, 3, image.Pt(2, 1), image.Pt(2, 0)},
+		{8, 2, 3, image.Pt(2, 0), image.Pt(2, 1)},
+	} {
+		dst := applyOrientation(src, tt.o)
+		if b := dst.Bounds(); b.Dx() != tt.w || b.Dy() != tt.h {
+			t.Errorf("orientation %d: got %dx%d; want %dx%d", tt.o, b.Dx(), b.Dy(), tt.w, tt.h)
+			continue
+		}
+		for _, p := range []struct{ dst, src image.Point }{
+			{image.Pt(0, 0), tt.origin},
+			{image.Pt(1, 0), tt.next},
+		} {
+			got := color.NRGBAModel.Convert(dst.At(p.dst.X, p.dst.Y)).(color.NRGBA)
+			if int(got.R) != p.src.X || int(got.G) != p.src.Y {
+				t.Errorf("orientation %d: pixel at %v came from (%d,%d); want %v",
+					tt.o, p.dst, got.R, got.G, p.src)
+			}
+		}
+	}
+}
+
+// exifJPEG encodes m as a JPEG with an EXIF orientation tag.
+func exifJPEG(t *testing.T, m image.Image, orientation int) []byte {
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, m, nil); err != nil {
+		t.Fatal(err)
+	}
+	tiff := []byte{
+		'M', 'M', 0, 42, 0, 0, 0, 8, // header
+		0, 1, // one IFD entry
+		0x01, 0x12, 0, 3, 0, 0, 0, 1, 0, byte(orientation), 0, 0,
+		0, 0, 0, 0, // no next IFD
+	}
+	app1 := append([]byte("Exif\x00\x00"), tiff...)
+	seg := []byte{0xff, 0xe1, 0, byte(len(app1) + 2)}
+	b := buf.Bytes()
+	out := append([]byte(nil), b[:2]...) // SOI
+	out = append(out, seg...)
+	out = append(out, app1...)
+	return append(out, b[2:]...)
+}
+
+func TestImageOrientation(t *testing.T) {
+	td := newTempDir(t)
+	defer td.remove()
+
+	td.writeFile("sitkin/config.json", `{"images": [{"match": ["photos/*.jpg"], "widths": [20]}]}`)
+	td.writeFile("sitkin/default.tmpl", `{{block "contents" .}}{{end}}`)
+	td.writeFile("index.tmpl", `{{define "contents"}}{{img "/photos/a.jpg"}}{{end}}`)
+	// A portrait photo stored sideways: the top of the scene is on the
+	// left, which is white.
+	m := image.NewNRGBA(image.Rect(0, 0, 100, 50))
+	for x := 0; x < 100; x++ {
+		for y := 0; y < 50; y++ {
+			c := color.NRGBA{0, 0, 0, 255}
+			if x < 50 {
+				c = color.NRGBA{255, 255, 255, 255}
+			}
+			m.Set(x, y, c)
+		}
+	}
+	b := exifJPEG(t, m, 6)
+	td.writeFile("photos/a.jpg", string(b))
+
+	f := bytes.NewReader(b)
+	if o, err := jpegOrientation(f); err != nil || o != 6 {
+		t.Fatalf("jpegOrientation: got (%d, %v); want 6", o, err)
+	}
+
+	s, err := load(td.dir, options{})
+	if err != nil {
+		t.Fatal("load failed:", err)
+	}
+	if err := s.render(context.Background()); err != nil {
+		t.Fatal("render failed:", err)
+	}
+	h := hashBase62(string(b))
+	full := "/photos/a." + h + ".jpg"
+	w20 := "/photos/a.w20." + imageVariantHash(h, 20, defaultImageQuality) + ".jpg"
+	td.checkFile(
+		"gen/index.html",
+		`<img src=`+full+` srcset="`+w20+` 20w, `+full+` 50w" sizes=100vw width=50 height=100>`,
+	)
+	vf, err := os.Open(td.path("gen" + w20))
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err := jpeg.Decode(vf)
+	vf.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b := v.Bounds(); b.Dx() != 20 || b.Dy() != 40 {
+		t.Fatalf("variant is %dx%d; want 20x40", b.Dx(), b.Dy())
+	}
+	top, _, _, _ := v.At(10, 5).RGBA()
+	bottom, _, _, _ := v.At(10, 35).RGBA()
+	if top < 0xc000 || bottom > 0x4000 {
+		t.Errorf("variant is not upright: top pixel %#x, bottom pixel %#x", top, bottom)
+	}
+}
+
+func TestImagesDevMode(t *testing.T) {
+	td := newTempDir(t)
+	defer td.remove()
+
+	td.writeFile("sitkin/config.json", `{"images": [{"match": ["photos/*.png"], "widths": [20]}]}`)
+	td.writeFile("sitkin/default.tmpl", `{{block "contents" .}}{{end}}`)
+	td.writeFile("index.tmpl", `{{define "contents"}}{{img "/photos/a.png"}}{{end}}`)
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewNRGBA(image.Rect(0, 0, 100, 50))); err != nil {
+		t.Fatal(err)
+	}
+	td.writeFile("photos/a.png", buf.String())
+
+	build := func() {
+		t.Helper()
+		s, err := load(td.dir, options{devMode: true, noCache: true})
+		if err != nil {
+			t.Fatal("load failed:", err)
+		}
+		if err := s.render(context.Background()); err != nil {
+			t.Fatal("render failed:", err)
+		}
+	}
+	const variant = "gen/photos/a.w20.NOHASH.png"
+	build()
+	if _, err := os.Stat(td.path(variant)); err != nil {
+		t.Fatal(err)
+	}
+
+	// A variant that is newer than the source is not rendered again.
+	td.writeFile(variant, "old")
+	future := time.Now().Add(time.Hour)
+	if err := os.Chtimes(td.path(variant), future, future); err != nil {
+		t.Fatal(err)
+	}
+	build()
+	td.checkFile(variant, "old")
+
+	// Once the source changes, the variant is rendered again.
+	later := future.Add(time.Hour)
+	if err := os.Chtimes(td.path("photos/a.png"), later, later); err != nil {
+		t.Fatal(err)
+	}
+	build()
+	f, err := os.Open(td.path(variant))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := png.DecodeConfig(f); err != nil {
+		t.Fatal("variant was not rendered again:", err)
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// checkOutputs makes sure that no two sources are written to the same
+// output path (including the precompressed copies of the outputs). It
+// reports every collision at once, before anything is rendered.
+func (s *sitkin) checkOutputs() error {
+	outputs := make(map[string][]string) // output path -> sources
+	small := make(map[string]bool)       // outputs too small to precompress
+	add := func(outPath, source string) {
+		outputs[outPath] = append(outputs[outPath], source)
+	}
+	// The size of a copied file (or bundle) is known in advance; minifying
+	// it only makes it smaller.
+	tooSmall := func(size int64) bool {
+		return size < s.config.Precompress.MinSize
+	}
+	for _, fs := range s.fileSets {
+		for _, md := range fs.Files {
+			add(md.outPath, filepath.ToSlash(md.srcPath))
+		}
+	}
+	for _, md := range s.markdownFiles {
+		add(md.outPath, md.srcPath)
+	}
+	for _, tf := range s.templateFiles {
+		add(tf.outPath, tf.name+".tmpl")
+	}
+	for _, ttf := range s.textTemplateFiles {
+		add(ttf.name, ttf.name+".tpl")
+	}
+	for _, cf := range s.copyFiles {
+		add(cf.dstPath, filepath.ToSlash(cf.srcPath))
+		if stat, err := os.Stat(filepath.Join(s.dir, cf.srcPath)); err == nil && tooSmall(stat.Size()) {
+			small[cf.dstPath] = true
+		}
+	}
+	for _, b := range s.bundles {
+		add(b.dstPath, "bundle "+b.name)
+		if tooSmall(int64(len(b.contents))) {
+			small[b.dstPath] = true
+		}
+	}
+	for _, img := range s.images {
+		for _, v := range img.variants {
+			add(v.dstPath, "resized "+filepath.ToSlash(img.srcPath))
+		}
+	}
+	for _, r := range s.redirects {
+		add(r.outPath, r.source+" from "+r.from)
+	}
+	if name, _ := s.redirectFile(); name != "" {
+		add(name, "redirect file")
+	}
+	var compressed []string
+	for outPath, sources := range outputs {
+		if _, ok := compressExts[strings.ToLower(filepath.Ext(outPath))]; ok && !small[outPath] && len(sources) == 1 {
+			compressed = append(compressed, outPath)
+		}
+	}
+	for _, outPath := range compressed {
+		for _, format := range s.config.Precompress.Formats {
+			add(outPath+compressFormats[format], format+" of "+outputs[outPath][0])
+		}
+	}
+
+	var collisions []string
+	for outPath, sources := range outputs {
+		if len(sources) > 1 {
+			sort.Strings(sources)
+			collisions = append(collisions, fmt.Sprintf("%s is generated by %s",
+				filepath.ToSlash(outPath), strings.Join(sources, ", ")))
+		}
+	}
+	switch len(collisions) {
+	case 0:
+		return nil
+	case 1:
+		return fmt.Errorf("output path collision: %s", collisions[0])
+	default:
+		sort.Strings(collisions)
+		return fmt.Errorf("%d output path collisions:\n\t%s",
+			len(collisions), strings.Join(collisions, "\n\t"))
+	}
+}
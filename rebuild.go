@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+// A rebuilder runs dev mode builds in the background as the watcher reports
+// changes. At most one build runs at a time and at most one more is pending:
+// changes that arrive during a build cancel it, and the next build covers
+// both the canceled build's changes and the new ones.
+type rebuilder struct {
+	build func(ctx context.Context, changes []change) error
+
+	mu      sync.Mutex
+	pending []change
+	cancel  context.CancelFunc // cancels the running build, if any
+	kick    chan struct{}      // signals that there are pending changes
+}
+
+func newRebuilder(build func(ctx context.Context, changes []change) error) *rebuilder {
+	return &rebuilder{
+		build: build,
+		kick:  make(chan struct{}, 1),
+	}
+}
+
+// changed queues a build for changes, canceling the running build (if
+// there is one). It does not block.
+func (rb *rebuilder) changed(changes []change) {
+	rb.mu.Lock()
+	rb.pending = append(rb.pending, changes...)
+	if rb.cancel != nil {
+		rb.cancel()
+	}
+	rb.mu.Unlock()
+	select {
+	case rb.kick <- struct{}{}:
+	default: // a build is already pending
+	}
+}
+
+// run runs builds as they are queued. It does not return.
+func (rb *rebuilder) run() {
+	for range rb.kick {
+		rb.mu.Lock()
+		changes := rb.pending
+		rb.pending = nil
+		ctx, cancel := context.WithCancel(context.Background())
+		rb.cancel = cancel
+		rb.mu.Unlock()
+
+		err := rb.build(ctx, changes)
+
+		rb.mu.Lock()
+		if err != nil && ctx.Err() != nil {
+			// The build was canceled, so the next one must take its
+			// changes into account too.
+			rb.pending = append(changes, rb.pending...)
+		}
+		rb.cancel = nil
+		rb.mu.Unlock()
+		cancel()
+	}
+}
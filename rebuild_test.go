@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+func TestRebuilder(t *testing.T) {
+	started := make(chan []change)
+	release := make(chan struct{})
+	rb := newRebuilder(func(ctx context.Context, changes []change) error {
+		started <- changes
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-release:
+			return nil
+		}
+	})
+	go rb.run()
+
+	a := change{"a", fsnotify.Write}
+	b := change{"b", fsnotify.Create}
+	c := change{"c", fsnotify.Remove}
+	d := change{"d", fsnotify.Write}
+	check := func(want ...change) {
+		t.Helper()
+		if got := <-started; !reflect.DeepEqual(got, want) {
+			t.Fatalf("build started with %v; want %v", got, want)
+		}
+	}
+
+	rb.changed([]change{a})
+	check(a)
+	// Cancel the running build; the next build includes its changes.
+	rb.changed([]change{b, c})
+	check(a, b, c)
+	release <- struct{}{}
+
+	rb.changed([]change{d})
+	check(d)
+	release <- struct{}{}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"io"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// A redirect is a URL path that sends visitors elsewhere. Each redirect
+// gets an HTML stub page with a meta refresh and, optionally, an entry in a
+// redirects file for the web server.
+type redirect struct {
+	from    string // URL path
+	to      string // URL
+	outPath string // stub page path, relative to the gen dir
+	source  string // what declared the redirect (for error messages)
+}
+
+// loadRedirects collects the redirects from config.json and from the
+// aliases of markdown files.
+func (s *sitkin) loadRedirects() error {
+	var redirects []*redirect
+	for from, to := range s.config.Redirects {
+		redirects = append(redirects, &redirect{
+			from:    from,
+			to:      to,
+			outPath: permalinkOutPath(from, from),
+			source:  "redirect in config.json",
+		})
+	}
+	var files []*markdownFile
+	for _, fs := range s.fileSets {
+		files = append(files, fs.Files...)
+	}
+	files = append(files, s.markdownFiles...)
+	for _, md := range files {
+		aliases, err := metadataStrings(md.Metadata, "aliases")
+		if err != nil {
+			return fmt.Errorf("bad aliases for %s: %s", md.Permalink, err)
+		}
+		for _, alias := range aliases {
+			if !strings.HasPrefix(alias, "/") {
+				return fmt.Errorf("bad alias %q for %s (must begin with /)", alias, md.Permalink)
+			}
+			redirects = append(redirects, &redirect{
+				from:    alias,
+				to:      md.Permalink,
+				outPath: permalinkOutPath(alias, alias),
+				source:  "alias in " + filepath.ToSlash(md.srcPath),
+			})
+		}
+	}
+	sort.Slice(redirects, func(i, j int) bool {
+		return redirects[i].from < redirects[j].from
+	})
+	s.redirects = redirects
+	return nil
+}
+
+// metadataStrings returns the metadata value for key as a list of strings.
+// The value may be either a string or a list of strings.
+func metadataStrings(metadata map[string]interface{}, key string) ([]string, error) {
+	switch v := metadata[key].(type) {
+	case nil:
+		return nil, nil
+	case string:
+		return []string{v}, nil
+	case []interface{}:
+		ss := make([]string, len(v))
+		for i, x := range v {
+			s, ok := x.(string)
+			if !ok {
+				return nil, fmt.Errorf("%s contains non-string value %v", key, x)
+			}
+			ss[i] = s
+		}
+		return ss, nil
+	default:
+		return nil, fmt.Errorf("%s is not a string or list of strings", key)
+	}
+}
+
+var redirectStubTmpl = template.Must(template.New("").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Redirecting to {{.}}</title>
+<link rel="canonical" href="{{.}}">
+<meta http-equiv="refresh" content="0; url={{.}}">
+</head>
+<body>
+<p>This page has moved to <a href="{{.}}">{{.}}</a>.</p>
+</body>
+</html>
+`))
+
+func (s *sitkin) renderRedirects(genDir string) error {
+	for _, r := range s.redirects {
+		err := s.createFile(filepath.Join(genDir, r.outPath), func(w io.Writer) error {
+			return redirectStubTmpl.Execute(w, r.to)
+		})
+		if err != nil {
+			return fmt.Errorf("error writing redirect from %s: %s", r.from, err)
+		}
+	}
+
+	name, format := s.redirectFile()
+	if name == "" {
+		return nil
+	}
+	return s.createFile(filepath.Join(genDir, name), func(w io.Writer) error {
+		for _, r := range s.redirects {
+			if _, err := fmt.Fprintf(w, format, r.from, r.to); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// redirectFile returns the name of the configured redirects file (or the
+// empty string, if there isn't one) along with the format of its lines.
+func (s *sitkin) redirectFile() (name, lineFormat string) {
+	switch s.config.RedirectFile {
+	case "netlify":
+		// https://docs.netlify.com/routing/redirects/
+		return "_redirects", "%s %s 301\n"
+	case "nginx":
+		// For use with a map block: map $uri $redirect { include ...; }
+		return "redirects.map", "%s %s;\n"
+	default:
+		return "", ""
+	}
+}
@@ -2,10 +2,11 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha256"
+	"crypto/tls"
 	"encoding/binary"
 	"encoding/json"
-	"encoding/xml"
 	"errors"
 	"flag"
 	"fmt"
@@ -18,11 +19,13 @@ import (
 	"os/exec"
 	"path"
 	"path/filepath"
+	"regexp"
 	"runtime"
 	"sort"
 	"strings"
 	texttemplate "text/template"
 	"time"
+	"unicode"
 
 	"github.com/tdewolff/minify/v2"
 	"github.com/tdewolff/minify/v2/html"
@@ -31,28 +34,179 @@ import (
 	goldmarkhtml "github.com/yuin/goldmark/renderer/html"
 )
 
+// config is the contents of sitkin/config.json.
+type config struct {
+	Ignore   []string
+	NoHash   []string
+	FileSets []string
+	Images   []imageConfig
+	Minify   []string
+	Bundles  map[string][]string
+
+	Precompress  precompressConfig
+	CopyMode     string
+	Redirects    map[string]string
+	PrettyURLs   bool
+	Permalinks   map[string]string // file set name -> pattern
+	RedirectFile string
+	DevProxy     map[string]string // URL prefix -> upstream URL
+	Watch        []string          // extra dirs to watch in dev mode
+	Layouts      map[string]string // template name -> parent template name
+	Site         map[string]interface{}
+	Drafts       *bool // whether to render drafts; the default is dev mode only
+	Profiles     map[string]profileConfig
+}
+
+// A profileConfig overrides parts of the config when the profile is
+// selected with -env.
+type profileConfig struct {
+	Site   map[string]interface{} // merged with the config's site values
+	Ignore []string
+	Drafts *bool
+	Minify []string
+}
+
 type sitkin struct {
 	dir     string
 	devMode bool
 	verbose bool
-	config  struct {
-		Ignore   []string
-		NoHash   []string
-		FileSets []string
-	}
+	config  config
 
 	templates         map[string]*template.Template
+	baseTemplates     map[string]*template.Template // parsed from the sitkin dir; never executed
+	basePartials      *template.Template            // parsed from sitkin/partials; never executed
+	layoutParents     map[string]string             // template name -> parent template name
+	partials          *template.Template
 	fileSets          []*fileSet
 	templateFiles     []*templateFile
 	textTemplateFiles []*textTemplateFile
 	markdownFiles     []*markdownFile
 	copyFiles         []*copyFile
-	hashAssets        map[string]string // "/styles/x.css" -> "/styles/x.asdf123.css"
+	bundles           []*bundle
+	redirects         []*redirect
+	outputs           map[string]struct{}    // files written by the current render
+	unchanged         map[string]struct{}    // outputs the current render left as they were
+	copyFallback      bool                   // whether the copy mode fallback was logged
+	hashAssets        map[string]string      // "/styles/x.css" -> "/styles/x.asdf123.css"
+	images            map[string]*imageAsset // "/images/x.jpg" -> resized variants
+
+	cache *buildCache
 
-	ctx *context
+	tmplCtx *tmplContext
+}
+
+// options are the build settings given on the command line.
+type options struct {
+	devMode bool
+	verbose bool
+	noCache bool
+	profile string // from -env
+}
+
+// readConfig decodes the config file of the project in dir, if it exists,
+// into cfg and applies the named profile (if profile is not empty). It
+// returns the raw contents of the file.
+func readConfig(dir, profile string, cfg *config) ([]byte, error) {
+	configJSON, err := os.ReadFile(filepath.Join(dir, "sitkin", "config.json"))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return nil, err
+		}
+		configJSON = nil
+	} else if err := json.Unmarshal(configJSON, cfg); err != nil {
+		return nil, fmt.Errorf("error loading config.json: %s", err)
+	}
+	if profile != "" {
+		if err := cfg.applyProfile(profile); err != nil {
+			return nil, err
+		}
+	}
+	return configJSON, nil
 }
 
-func load(dir string, devMode, verbose bool) (*sitkin, error) {
+// applyProfile overrides cfg with the settings of the named profile. The
+// profile's site values are merged into the config's; its other settings
+// replace the config's if they are given.
+func (cfg *config) applyProfile(name string) error {
+	p, ok := cfg.Profiles[name]
+	if !ok {
+		return fmt.Errorf("unknown profile %q", name)
+	}
+	if len(p.Site) > 0 {
+		site := make(map[string]interface{}, len(cfg.Site)+len(p.Site))
+		for k, v := range cfg.Site {
+			site[k] = v
+		}
+		for k, v := range p.Site {
+			site[k] = v
+		}
+		cfg.Site = site
+	}
+	if p.Ignore != nil {
+		cfg.Ignore = p.Ignore
+	}
+	if p.Drafts != nil {
+		cfg.Drafts = p.Drafts
+	}
+	if p.Minify != nil {
+		cfg.Minify = p.Minify
+	}
+	return nil
+}
+
+// siteEnvPrefix begins the names of environment variables which override
+// the site section of config.json.
+const siteEnvPrefix = "SITKIN_SITE_"
+
+// siteParams returns the site parameters from config.json with overrides
+// from env (in the form returned by os.Environ). SITKIN_SITE_X=y sets the
+// parameter whose name is x, ignoring case, to y. If the parameter's value
+// in the config is a string (or there is no such parameter, in which case x
+// is used in lowercase), y is used as-is; otherwise y is decoded as JSON so
+// that, for example, false stays a boolean.
+func siteParams(site map[string]interface{}, env []string) (map[string]interface{}, error) {
+	params := make(map[string]interface{}, len(site))
+	for k, v := range site {
+		params[k] = v
+	}
+	for _, kv := range env {
+		name, val, ok := strings.Cut(kv, "=")
+		if !ok || !strings.HasPrefix(name, siteEnvPrefix) {
+			continue
+		}
+		key := strings.ToLower(strings.TrimPrefix(name, siteEnvPrefix))
+		if key == "" {
+			continue
+		}
+		for k := range site {
+			if strings.EqualFold(k, key) {
+				key = k
+				break
+			}
+		}
+		switch site[key].(type) {
+		case nil, string:
+			params[key] = val
+		default:
+			var v interface{}
+			if err := json.Unmarshal([]byte(val), &v); err != nil {
+				return nil, fmt.Errorf("bad value for %s (must be JSON, like the config value): %s", name, err)
+			}
+			params[key] = v
+		}
+	}
+	return params, nil
+}
+
+func load(dir string, opts options) (*sitkin, error) {
+	return reload(context.Background(), dir, opts, nil)
+}
+
+// reload is like load, but if prev is non-nil, the templates in the sitkin
+// dir are not parsed again; prev's templates are reused instead. This is
+// only correct if nothing in the sitkin dir has changed since prev was
+// loaded. It stops early, returning ctx.Err(), if ctx is canceled.
+func reload(ctx context.Context, dir string, opts options, prev *sitkin) (*sitkin, error) {
 	// Initial sanity check.
 	sitkinDir := filepath.Join(dir, "sitkin")
 	stat, err := os.Stat(sitkinDir)
@@ -68,25 +222,21 @@ func load(dir string, devMode, verbose bool) (*sitkin, error) {
 
 	s := &sitkin{
 		dir:        dir,
-		devMode:    devMode,
-		verbose:    verbose,
+		devMode:    opts.devMode,
+		verbose:    opts.verbose,
 		templates:  make(map[string]*template.Template),
 		hashAssets: make(map[string]string),
-		ctx: &context{
-			DevMode:  devMode,
+		images:     make(map[string]*imageAsset),
+		tmplCtx: &tmplContext{
+			DevMode:  opts.devMode,
+			Profile:  opts.profile,
 			FileSets: make(map[string]*fileSet),
 		},
 	}
 
 	// Load config file, if it exists.
-	f, err := os.Open(filepath.Join(sitkinDir, "config.json"))
-	if err == nil {
-		err := json.NewDecoder(f).Decode(&s.config)
-		f.Close()
-		if err != nil {
-			return nil, fmt.Errorf("error loading config.json: %s", err)
-		}
-	} else if !os.IsNotExist(err) {
+	configJSON, err := readConfig(dir, opts.profile, &s.config)
+	if err != nil {
 		return nil, err
 	}
 	for _, glob := range s.config.Ignore {
@@ -99,39 +249,108 @@ func load(dir string, devMode, verbose bool) (*sitkin, error) {
 			return nil, fmt.Errorf("bad nohash glob %q: %s", glob, err)
 		}
 	}
+	for i := range s.config.Images {
+		if err := s.config.Images[i].check(); err != nil {
+			return nil, err
+		}
+	}
+	if err := checkMinifyTypes(s.config.Minify); err != nil {
+		return nil, err
+	}
+	if err := s.config.Precompress.check(); err != nil {
+		return nil, err
+	}
+	switch s.config.CopyMode {
+	case "", "copy", "hardlink", "reflink":
+	default:
+		return nil, fmt.Errorf("unknown copy mode %q", s.config.CopyMode)
+	}
+	for from := range s.config.Redirects {
+		if !strings.HasPrefix(from, "/") {
+			return nil, fmt.Errorf("bad redirect %q (path must begin with /)", from)
+		}
+	}
+	switch s.config.RedirectFile {
+	case "", "netlify", "nginx":
+	default:
+		return nil, fmt.Errorf("unknown redirect file format %q", s.config.RedirectFile)
+	}
+	for prefix, upstream := range s.config.DevProxy {
+		if !strings.HasPrefix(prefix, "/") {
+			return nil, fmt.Errorf("bad devProxy prefix %q (must begin with /)", prefix)
+		}
+		if _, err := parseUpstream(upstream); err != nil {
+			return nil, fmt.Errorf("bad devProxy upstream for %s: %s", prefix, err)
+		}
+	}
+
+	if !opts.noCache {
+		s.cache = loadBuildCache(dir, configJSON, opts.devMode, opts.verbose)
+	}
 
 	// Load templates.
-	defaultTmpl, err := s.parseTemplateFile(filepath.Join(sitkinDir, "default.tmpl"))
-	if err != nil {
-		return nil, fmt.Errorf("error loading default template: %s", err)
+	if prev != nil {
+		s.baseTemplates = prev.baseTemplates
+		s.basePartials = prev.basePartials
+		s.layoutParents = prev.layoutParents
+	} else if err := s.loadTemplates(sitkinDir); err != nil {
+		return nil, err
 	}
-	tmplFiles, err := filepath.Glob(filepath.Join(sitkinDir, "*.tmpl"))
+	partials, err := s.basePartials.Clone()
 	if err != nil {
-		return nil, fmt.Errorf("error listing templates: %s", err)
+		panic(err) // base templates are never executed
 	}
-	s.templates["default"] = defaultTmpl
+	s.partials = partials.Funcs(s.tmplFuncs())
 	unusedTemplates := make(map[string]struct{})
-	for _, name := range tmplFiles {
-		tmplName := strings.TrimSuffix(filepath.Base(name), ".tmpl")
-		if tmplName == "default" {
-			continue
-		}
-		tmpl, err := s.parseTemplateFileWithDefault(name)
+	for name, base := range s.baseTemplates {
+		tmpl, err := base.Clone()
 		if err != nil {
-			return nil, fmt.Errorf("error loading template %s: %s", name, err)
+			panic(err) // base templates are never executed
+		}
+		// Bind the functions to s rather than to the sitkin that parsed
+		// the base templates.
+		s.templates[name] = tmpl.Funcs(s.tmplFuncs())
+		if name != "default" {
+			unusedTemplates[name] = struct{}{}
+		}
+	}
+	for _, parent := range s.layoutParents {
+		delete(unusedTemplates, parent)
+	}
+
+	s.tmplCtx.Site, err = siteParams(s.config.Site, os.Environ())
+	if err != nil {
+		return nil, err
+	}
+	s.tmplCtx.Data, err = loadData(filepath.Join(sitkinDir, "data"))
+	if err != nil {
+		return nil, err
+	}
+
+	isFileSetName := func(name string) bool {
+		for _, n := range s.config.FileSets {
+			if n == name {
+				return true
+			}
 		}
-		s.templates[tmplName] = tmpl
-		unusedTemplates[tmplName] = struct{}{}
+		return false
 	}
 
 	// Load the file sets.
+	for name, pattern := range s.config.Permalinks {
+		if !isFileSetName(name) {
+			return nil, fmt.Errorf("permalink pattern given for unknown file set %s", name)
+		}
+		if !strings.HasPrefix(pattern, "/") {
+			return nil, fmt.Errorf("bad permalink pattern %q for file set %s (must begin with /)", pattern, name)
+		}
+	}
 	for _, name := range s.config.FileSets {
-		tmpl, ok := s.templates[name]
-		if !ok {
+		if _, ok := s.templates[name]; !ok {
 			return nil, fmt.Errorf("no template for file set %s", name)
 		}
 		fsDir := filepath.Join(dir, name)
-		fs, err := s.loadFileSet(fsDir, tmpl)
+		fs, err := s.loadFileSet(fsDir, name)
 		if err != nil {
 			if os.IsNotExist(err) {
 				return nil, fmt.Errorf("no directory for file set %s", name)
@@ -140,15 +359,9 @@ func load(dir string, devMode, verbose bool) (*sitkin, error) {
 		}
 		s.fileSets = append(s.fileSets, fs)
 		delete(unusedTemplates, name)
-	}
-
-	isFileSetName := func(name string) bool {
-		for _, n := range s.config.FileSets {
-			if n == name {
-				return true
-			}
+		for _, md := range fs.Files {
+			delete(unusedTemplates, md.layout)
 		}
-		return false
 	}
 
 	// Categorize all the rest of the files in the project.
@@ -157,6 +370,9 @@ func load(dir string, devMode, verbose bool) (*sitkin, error) {
 		return nil, fmt.Errorf("error reading files in project dir: %s", err)
 	}
 	for _, fi := range fis {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
 		name := fi.Name() // basename, since fi came from readdir
 		switch {
 		case name == "sitkin" ||
@@ -165,14 +381,16 @@ func load(dir string, devMode, verbose bool) (*sitkin, error) {
 			isFileSetName(name):
 			// Don't copy these.
 		case strings.HasSuffix(name, ".tmpl"):
-			tmpl, err := s.parseTemplateFileWithDefault(filepath.Join(dir, name))
+			tmpl, layout, err := s.parsePageTemplateFile(filepath.Join(dir, name))
 			if err != nil {
 				return nil, fmt.Errorf("error loading template %s: %s", name, err)
 			}
+			delete(unusedTemplates, layout)
 			tf := &templateFile{
 				name: strings.TrimSuffix(filepath.Base(name), ".tmpl"),
 				tmpl: tmpl,
 			}
+			tf.outPath, _ = s.pagePaths(tf.name)
 			s.templateFiles = append(s.templateFiles, tf)
 		case strings.HasSuffix(name, ".tpl"):
 			tmpl, err := s.parseTextTemplateFile(filepath.Join(dir, name))
@@ -185,17 +403,18 @@ func load(dir string, devMode, verbose bool) (*sitkin, error) {
 			}
 			s.textTemplateFiles = append(s.textTemplateFiles, ttf)
 		case strings.HasSuffix(name, ".md"):
-			base := strings.TrimSuffix(name, ".md")
-			tmpl, ok := s.templates[base]
-			if ok {
-				delete(unusedTemplates, base)
-			} else {
-				tmpl = defaultTmpl
+			layout := strings.TrimSuffix(name, ".md")
+			if _, ok := s.templates[layout]; !ok {
+				layout = "default"
 			}
-			md, err := s.loadMarkdownFile(filepath.Join(dir, name), tmpl)
+			md, err := s.loadMarkdownFile(filepath.Join(dir, name), layout)
 			if err != nil {
 				return nil, fmt.Errorf("error loading markdown file %s: %s", name, err)
 			}
+			if md == nil {
+				continue // hidden draft
+			}
+			delete(unusedTemplates, md.layout)
 			s.markdownFiles = append(s.markdownFiles, md)
 		default:
 			copyFiles, hashAssets, err := s.loadCopyFiles(dir, name)
@@ -218,9 +437,25 @@ func load(dir string, devMode, verbose bool) (*sitkin, error) {
 		log.Println("Warning: the following templates are not used:", unused)
 	}
 
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if err := s.loadImages(); err != nil {
+		return nil, err
+	}
+	if err := s.loadBundles(); err != nil {
+		return nil, err
+	}
+	if err := s.loadRedirects(); err != nil {
+		return nil, err
+	}
+	if err := s.checkOutputs(); err != nil {
+		return nil, err
+	}
+
 	// Fill in context.
 	for _, fs := range s.fileSets {
-		s.ctx.FileSets[fs.name] = fs
+		s.tmplCtx.FileSets[fs.name] = fs
 	}
 
 	if s.verbose {
@@ -239,17 +474,16 @@ func load(dir string, devMode, verbose bool) (*sitkin, error) {
 }
 
 func (s *sitkin) tmplFuncs() template.FuncMap {
-	return template.FuncMap{
-		"formatRFC3339": func(t time.Time) string { return t.Format(time.RFC3339) },
-		"xmlEscape": func(b template.HTML) (string, error) {
-			var buf strings.Builder
-			if err := xml.EscapeText(&buf, []byte(b)); err != nil {
-				return "", err
-			}
-			return buf.String(), nil
-		},
-		"link": s.link,
+	funcs := template.FuncMap{
+		"link":    s.link,
+		"img":     s.img,
+		"pageURL": s.pageURL,
+		"partial": s.partial,
+	}
+	for name, fn := range builtinFuncs {
+		funcs[name] = fn
 	}
+	return funcs
 }
 
 func (s *sitkin) link(href string) string {
@@ -276,23 +510,191 @@ func (s *sitkin) parseTextTemplateFile(name string) (*texttemplate.Template, err
 	return t.Lookup(filepath.Base(name)).Option("missingkey=error"), nil
 }
 
-func (s *sitkin) parseTextTemplate(text string) (*texttemplate.Template, error) {
+func (s *sitkin) parseTextTemplate(name, text string) (*texttemplate.Template, error) {
 	funcs := texttemplate.FuncMap(s.tmplFuncs())
-	t, err := texttemplate.New("").Funcs(funcs).Parse(text)
+	t, err := texttemplate.New(name).Funcs(funcs).Parse(text)
 	if err != nil {
 		return nil, err
 	}
 	return t.Option("missingkey=error"), nil
 }
 
-func (s *sitkin) parseTemplateFileWithDefault(name string) (*template.Template, error) {
-	t, err := s.templates["default"].Clone()
+// parsePageTemplateFile parses a top-level template file into a clone of
+// its layout: the template named by its parent comment (see layoutParent),
+// or else the default template.
+func (s *sitkin) parsePageTemplateFile(name string) (tmpl *template.Template, layout string, err error) {
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return nil, "", err
+	}
+	layout = layoutParent(b)
+	if layout == "" {
+		layout = "default"
+	}
+	base, ok := s.templates[layout]
+	if !ok {
+		return nil, "", fmt.Errorf("unknown layout %s", layout)
+	}
+	tmpl, err = parseTemplateFileWith(base, name)
+	return tmpl, layout, err
+}
+
+var layoutParentComment = regexp.MustCompile(`^\s*\{\{-?\s*/\*\s*parent:\s*(\S+?)\s*\*/\s*-?\}\}`)
+
+// layoutParent returns the name of the parent template declared by a
+// comment like {{/* parent: article */}} at the beginning of a template, or
+// the empty string if there is no such comment.
+func layoutParent(tmpl []byte) string {
+	m := layoutParentComment.FindSubmatch(tmpl)
+	if m == nil {
+		return ""
+	}
+	return string(m[1])
+}
+
+func parseTemplateFileWith(base *template.Template, name string) (*template.Template, error) {
+	t, err := base.Clone()
 	if err != nil {
 		panic(err)
 	}
 	return t.ParseFiles(name)
 }
 
+// loadTemplates parses default.tmpl and the other templates in sitkinDir
+// into s.baseTemplates and the partials into s.basePartials.
+//
+// Each template other than default.tmpl has a parent, which is named in
+// the config's layouts or by a comment at the top of the template (see
+// layoutParent) and is otherwise the default template. A template is parsed
+// into a clone of its parent, so it can override the parent's blocks.
+func (s *sitkin) loadTemplates(sitkinDir string) error {
+	defaultTmpl, err := s.parseTemplateFile(filepath.Join(sitkinDir, "default.tmpl"))
+	if err != nil {
+		return fmt.Errorf("error loading default template: %s", err)
+	}
+	if err := s.loadPartials(filepath.Join(sitkinDir, "partials")); err != nil {
+		return err
+	}
+	// Every template set is a clone of the default template, so adding the
+	// partials to it makes them available everywhere.
+	for _, t := range s.basePartials.Templates() {
+		if _, err := defaultTmpl.AddParseTree(t.Name(), t.Tree); err != nil {
+			return fmt.Errorf("error adding partial %s: %s", t.Name(), err)
+		}
+	}
+	tmplFiles, err := filepath.Glob(filepath.Join(sitkinDir, "*.tmpl"))
+	if err != nil {
+		return fmt.Errorf("error listing templates: %s", err)
+	}
+	s.baseTemplates = map[string]*template.Template{"default": defaultTmpl}
+	s.layoutParents = make(map[string]string)
+	paths := make(map[string]string) // template name -> file
+	for _, name := range tmplFiles {
+		tmplName := strings.TrimSuffix(filepath.Base(name), ".tmpl")
+		if tmplName == "default" {
+			continue
+		}
+		b, err := os.ReadFile(name)
+		if err != nil {
+			return fmt.Errorf("error loading template %s: %s", name, err)
+		}
+		parent, ok := s.config.Layouts[tmplName]
+		if !ok {
+			parent = layoutParent(b)
+		}
+		if parent == "" {
+			parent = "default"
+		}
+		paths[tmplName] = name
+		s.layoutParents[tmplName] = parent
+	}
+	for name := range s.config.Layouts {
+		if name == "default" {
+			return errors.New("the default template cannot have a parent")
+		}
+		if _, ok := paths[name]; !ok {
+			return fmt.Errorf("parent given for unknown template %s", name)
+		}
+	}
+
+	var parse func(name string, children []string) error
+	parse = func(name string, children []string) error {
+		if _, ok := s.baseTemplates[name]; ok {
+			return nil
+		}
+		for i, child := range children {
+			if child == name {
+				cycle := append(children[i:], name)
+				return fmt.Errorf("template parents form a cycle: %s", strings.Join(cycle, " -> "))
+			}
+		}
+		parent := s.layoutParents[name]
+		if _, ok := paths[parent]; !ok && parent != "default" {
+			return fmt.Errorf("template %s has unknown parent %s", name, parent)
+		}
+		if err := parse(parent, append(children, name)); err != nil {
+			return err
+		}
+		tmpl, err := parseTemplateFileWith(s.baseTemplates[parent], paths[name])
+		if err != nil {
+			return fmt.Errorf("error loading template %s: %s", paths[name], err)
+		}
+		s.baseTemplates[name] = tmpl
+		return nil
+	}
+	for _, name := range tmplFiles {
+		tmplName := strings.TrimSuffix(filepath.Base(name), ".tmpl")
+		if err := parse(tmplName, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadPartials parses the templates in dir (if it exists) into
+// s.basePartials. Each partial is named by its path relative to dir, using
+// slashes and without the .tmpl extension: partials/cards/post.tmpl is
+// named "cards/post".
+func (s *sitkin) loadPartials(dir string) error {
+	s.basePartials = template.New("").Funcs(s.tmplFuncs()).Option("missingkey=error")
+	return walkFollow(dir, func(pth string, fi os.FileInfo, err error) error {
+		if err != nil {
+			if pth == dir && os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if fi.IsDir() || !strings.HasSuffix(pth, ".tmpl") {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, pth)
+		if err != nil {
+			panic(err) // shouldn't happen
+		}
+		name := strings.TrimSuffix(filepath.ToSlash(rel), ".tmpl")
+		b, err := os.ReadFile(pth)
+		if err != nil {
+			return err
+		}
+		if _, err := s.basePartials.New(name).Parse(string(b)); err != nil {
+			return fmt.Errorf("error loading partial %s: %s", pth, err)
+		}
+		return nil
+	})
+}
+
+// partial renders the named partial template with data.
+func (s *sitkin) partial(name string, data interface{}) (template.HTML, error) {
+	if s.partials.Lookup(name) == nil {
+		return "", fmt.Errorf("no partial named %q", name)
+	}
+	var buf strings.Builder
+	if err := s.partials.ExecuteTemplate(&buf, name, data); err != nil {
+		return "", err
+	}
+	return template.HTML(buf.String()), nil
+}
+
 type fileSet struct {
 	name     string
 	Files    []*markdownFile
@@ -301,21 +703,29 @@ type fileSet struct {
 
 type markdownFile struct {
 	Name         string
+	Permalink    string // URL path of the rendered page
+	srcPath      string // relative to the project dir
+	outPath      string // relative to the gen dir
+	layout       string // name of the template that renders the page
 	tmpl         *template.Template
 	markdownTmpl *texttemplate.Template // templatized markdown
 	Contents     template.HTML          // markdownTmpl -> markdown -> HTML
+	Metadata     map[string]interface{}
 
-	// The remaining fields are not used for top-level markdown files.
-	Date     time.Time
-	Metadata map[string]interface{}
+	// Date is not set for top-level markdown files.
+	Date time.Time
 }
 
-func (s *sitkin) loadFileSet(dir string, tmpl *template.Template) (*fileSet, error) {
+// loadFileSet loads the markdown files in dir. The files are rendered using
+// the template named layout unless their metadata says otherwise.
+func (s *sitkin) loadFileSet(dir, layout string) (*fileSet, error) {
 	fis, err := os.ReadDir(dir)
 	if err != nil {
 		return nil, err
 	}
+	fsName := filepath.Base(dir)
 	names := make(map[string]struct{})
+	permalinks := make(map[string]string)
 	var files []*markdownFile
 	for _, fi := range fis {
 		name := fi.Name() // basename only, since this comes from readdir
@@ -342,9 +752,18 @@ func (s *sitkin) loadFileSet(dir string, tmpl *template.Template) (*fileSet, err
 		if err != nil {
 			return nil, fmt.Errorf("error loading markdown file %s: %s", pth, err)
 		}
+		if s.hideDraft(metadata) {
+			continue
+		}
+		mdLayout, err := s.markdownLayout(metadata, layout)
+		if err != nil {
+			return nil, fmt.Errorf("error loading markdown file %s: %s", pth, err)
+		}
 		md := &markdownFile{
 			Name:         parts[1],
-			tmpl:         tmpl,
+			srcPath:      filepath.Join(fsName, name),
+			layout:       mdLayout,
+			tmpl:         s.templates[mdLayout],
 			markdownTmpl: markdownTmpl,
 			Date:         t,
 			Metadata:     metadata,
@@ -353,13 +772,26 @@ func (s *sitkin) loadFileSet(dir string, tmpl *template.Template) (*fileSet, err
 			return nil, fmt.Errorf("duplicate name (%s) in file set", parts[1])
 		}
 		names[parts[1]] = struct{}{}
+		if pattern, ok := s.config.Permalinks[fsName]; ok {
+			md.Permalink, err = expandPermalink(pattern, fsName, md)
+			if err != nil {
+				return nil, fmt.Errorf("error making permalink for %s: %s", pth, err)
+			}
+			md.outPath = permalinkOutPath(pattern, md.Permalink)
+		} else {
+			md.outPath, md.Permalink = s.pagePaths(fsName + "/" + md.Name)
+		}
+		if other, ok := permalinks[md.Permalink]; ok {
+			return nil, fmt.Errorf("%s and %s have the same permalink (%s)", other, name, md.Permalink)
+		}
+		permalinks[md.Permalink] = name
 		files = append(files, md)
 	}
 	sort.Slice(files, func(i, j int) bool {
 		return files[i].Date.After(files[j].Date)
 	})
 	fs := &fileSet{
-		name:  filepath.Base(dir),
+		name:  fsName,
 		Files: files,
 	}
 	if len(files) > 0 {
@@ -369,10 +801,11 @@ func (s *sitkin) loadFileSet(dir string, tmpl *template.Template) (*fileSet, err
 }
 
 func (s *sitkin) loadMarkdownMetadata(pth string) (metadata map[string]interface{}, tmpl *texttemplate.Template, err error) {
-	b, err := os.ReadFile(pth)
+	orig, err := os.ReadFile(pth)
 	if err != nil {
 		return nil, nil, err
 	}
+	b := orig
 	var (
 		begin = []byte("<!--")
 		end   = []byte("-->")
@@ -392,16 +825,40 @@ func (s *sitkin) loadMarkdownMetadata(pth string) (metadata map[string]interface
 			b = b[1:]
 		}
 	}
-	tmpl, err = s.parseTextTemplate(string(b))
+	// Replace the metadata with blank lines (which don't change the
+	// rendered markdown) so that line numbers in template errors match
+	// the file.
+	lines := bytes.Count(orig[:len(orig)-len(b)], []byte("\n"))
+	text := strings.Repeat("\n", lines) + string(b)
+	tmpl, err = s.parseTextTemplate(pth, text)
 	if err != nil {
 		return nil, nil, err
 	}
 	return metadata, tmpl, nil
 }
 
+// markdownLayout returns the name of the template that renders a markdown
+// file with the given metadata: the value of the layout key, if there is
+// one, or else def.
+func (s *sitkin) markdownLayout(metadata map[string]interface{}, def string) (string, error) {
+	v, ok := metadata["layout"]
+	if !ok {
+		return def, nil
+	}
+	layout, ok := v.(string)
+	if !ok {
+		return "", errors.New("layout is not a string")
+	}
+	if _, ok := s.templates[layout]; !ok {
+		return "", fmt.Errorf("unknown layout %s", layout)
+	}
+	return layout, nil
+}
+
 type templateFile struct {
-	name string
-	tmpl *template.Template
+	name    string
+	outPath string // relative to the gen dir
+	tmpl    *template.Template
 }
 
 type textTemplateFile struct {
@@ -409,21 +866,155 @@ type textTemplateFile struct {
 	tmpl *texttemplate.Template
 }
 
-func (s *sitkin) loadMarkdownFile(name string, tmpl *template.Template) (*markdownFile, error) {
-	markdownTmpl, err := s.parseTextTemplateFile(name)
+// loadMarkdownFile loads a top-level markdown file, which is rendered using
+// the template named layout unless its metadata says otherwise. It returns
+// nil if the file is a draft that should not be rendered.
+func (s *sitkin) loadMarkdownFile(name, layout string) (*markdownFile, error) {
+	metadata, markdownTmpl, err := s.loadMarkdownMetadata(name)
 	if err != nil {
 		return nil, err
 	}
-	return &markdownFile{
+	if s.hideDraft(metadata) {
+		return nil, nil
+	}
+	layout, err = s.markdownLayout(metadata, layout)
+	if err != nil {
+		return nil, err
+	}
+	md := &markdownFile{
 		Name:         strings.TrimSuffix(filepath.Base(name), ".md"),
-		tmpl:         tmpl,
+		srcPath:      filepath.Base(name),
+		layout:       layout,
+		tmpl:         s.templates[layout],
 		markdownTmpl: markdownTmpl,
-	}, nil
+		Metadata:     metadata,
+	}
+	md.outPath, md.Permalink = s.pagePaths(md.Name)
+	return md, nil
+}
+
+// hideDraft reports whether a markdown file with the given metadata is a
+// draft (its draft key is true) that should not be rendered. Drafts are
+// rendered in dev mode unless the config says otherwise.
+func (s *sitkin) hideDraft(metadata map[string]interface{}) bool {
+	if draft, _ := metadata["draft"].(bool); !draft {
+		return false
+	}
+	if s.config.Drafts != nil {
+		return !*s.config.Drafts
+	}
+	return !s.devMode
+}
+
+// pagePaths returns the output path (relative to the gen dir) and the URL
+// path of the HTML page named name, which is a slash-separated path without
+// an extension, such as "about" or "posts/hello-world".
+//
+// Normally, the page "about" is written to about.html. With prettyURLs, it
+// is written to about/index.html and linked as /about/ instead. Index pages
+// and 404.html are never moved into their own directories.
+func (s *sitkin) pagePaths(name string) (outPath, permalink string) {
+	dir, base := path.Split(name)
+	switch {
+	case base == "index":
+		return filepath.FromSlash(name + ".html"), "/" + dir
+	case base == "404" && dir == "":
+		return "404.html", "/404.html"
+	case s.config.PrettyURLs:
+		return filepath.FromSlash(name + "/index.html"), "/" + name + "/"
+	default:
+		return filepath.FromSlash(name + ".html"), "/" + name + ".html"
+	}
+}
+
+var permalinkToken = regexp.MustCompile(`:[A-Za-z_][A-Za-z0-9_]*`)
+
+// expandPermalink fills in the tokens in a file set's permalink pattern for
+// the file md. The tokens are :year, :month, :day, :slug (the name of the
+// file, without the date), and :fileset; any other token :key is replaced
+// by the slugified value of the metadata key.
+func expandPermalink(pattern, fsName string, md *markdownFile) (string, error) {
+	var err error
+	permalink := permalinkToken.ReplaceAllStringFunc(pattern, func(tok string) string {
+		key := tok[1:]
+		switch key {
+		case "year":
+			return md.Date.Format("2006")
+		case "month":
+			return md.Date.Format("01")
+		case "day":
+			return md.Date.Format("02")
+		case "slug":
+			return md.Name
+		case "fileset":
+			return fsName
+		}
+		v, ok := md.Metadata[key]
+		if !ok {
+			if err == nil {
+				err = fmt.Errorf("no metadata key %q for permalink token %s", key, tok)
+			}
+			return ""
+		}
+		return slugify(fmt.Sprint(v))
+	})
+	if err != nil {
+		return "", err
+	}
+	return permalink, nil
+}
+
+// permalinkOutPath returns the output path (relative to the gen dir) for a
+// page with the given permalink, which was expanded from pattern. If the
+// pattern ends in a slash, the page is written to an index.html file;
+// otherwise .html is added unless the pattern already ends in .html (most
+// static hosts serve x.html for the URL x). The decision is made using the
+// pattern because an expanded slug may contain dots.
+func permalinkOutPath(pattern, permalink string) string {
+	name := strings.TrimPrefix(permalink, "/")
+	switch {
+	case strings.HasSuffix(pattern, "/"):
+		name += "index.html"
+	case !strings.HasSuffix(pattern, ".html"):
+		name += ".html"
+	}
+	return filepath.FromSlash(name)
+}
+
+// slugify converts s into a form suitable for a URL path segment: lowercase
+// letters and digits separated by single hyphens.
+func slugify(s string) string {
+	var b strings.Builder
+	hyphen := false
+	for _, r := range strings.ToLower(s) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			if hyphen && b.Len() > 0 {
+				b.WriteByte('-')
+			}
+			hyphen = false
+			b.WriteRune(r)
+		} else {
+			hyphen = true
+		}
+	}
+	return b.String()
+}
+
+// pageURL is the template function that returns the URL path of the page
+// at the given path (like "/about") for the current URL mode.
+func (s *sitkin) pageURL(upath string) string {
+	name := strings.Trim(upath, "/")
+	if name == "" {
+		return "/"
+	}
+	_, permalink := s.pagePaths(name)
+	return permalink
 }
 
 type copyFile struct {
 	srcPath string // relative to source dir
 	dstPath string // relative to dst dir; same as srcPath unless this has a hash name
+	minify  string // media type, if the file is minified while copying
 }
 
 func (s *sitkin) loadCopyFiles(dir, name string) (copyFiles []*copyFile, hashAssets [][2]string, err error) {
@@ -453,6 +1044,7 @@ func (s *sitkin) loadCopyFiles(dir, name string) (copyFiles []*copyFile, hashAss
 		cf := &copyFile{
 			srcPath: relpath,
 			dstPath: relpath,
+			minify:  s.minifyType(relpath),
 		}
 		hashName := true
 		switch filepath.Ext(pth) {
@@ -474,7 +1066,7 @@ func (s *sitkin) loadCopyFiles(dir, name string) (copyFiles []*copyFile, hashAss
 			if s.devMode {
 				h = "NOHASH"
 			} else {
-				h, err = fileHash(pth)
+				h, err = s.cache.fileHash(pth)
 				if err != nil {
 					return err
 				}
@@ -489,12 +1081,65 @@ func (s *sitkin) loadCopyFiles(dir, name string) (copyFiles []*copyFile, hashAss
 		copyFiles = append(copyFiles, cf)
 		return nil
 	}
-	if err := filepath.Walk(filepath.Join(dir, name), walk); err != nil {
+	if err := walkFollow(filepath.Join(dir, name), walk); err != nil {
 		return nil, nil, err
 	}
 	return copyFiles, hashAssets, nil
 }
 
+var errSymlinkCycle = errors.New("symlink cycle")
+
+// walkFollow is like filepath.Walk, but it follows symbolic links. If a
+// link leads to a directory that contains it, fn is called for the link
+// with an error wrapping errSymlinkCycle rather than walking it forever.
+func walkFollow(root string, fn filepath.WalkFunc) error {
+	info, err := os.Stat(root)
+	if err != nil {
+		err = fn(root, nil, err)
+	} else {
+		err = walkFollowDir(root, info, nil, fn)
+	}
+	if err == filepath.SkipDir || err == filepath.SkipAll {
+		return nil
+	}
+	return err
+}
+
+func walkFollowDir(name string, info os.FileInfo, parents []os.FileInfo, fn filepath.WalkFunc) error {
+	if !info.IsDir() {
+		return fn(name, info, nil)
+	}
+	for _, p := range parents {
+		if os.SameFile(p, info) {
+			return fn(name, info, fmt.Errorf("%w: %s leads to a directory that contains it", errSymlinkCycle, name))
+		}
+	}
+	if err := fn(name, info, nil); err != nil {
+		return err
+	}
+	entries, err := os.ReadDir(name)
+	if err != nil {
+		return fn(name, info, err)
+	}
+	parents = append(parents, info)
+	for _, e := range entries {
+		child := filepath.Join(name, e.Name())
+		childInfo, err := os.Stat(child)
+		if err != nil {
+			if err := fn(child, nil, err); err != nil && err != filepath.SkipDir {
+				return err
+			}
+			continue
+		}
+		if err := walkFollowDir(child, childInfo, parents, fn); err != nil {
+			if err != filepath.SkipDir || !childInfo.IsDir() {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
 func fileHash(name string) (string, error) {
 	f, err := os.Open(name)
 	if err != nil {
@@ -538,22 +1183,43 @@ func (cf *copyFile) copy(srcDir, dstDir string) error {
 		return err
 	}
 
-	parent := filepath.Dir(dst)
+	err = writeFileAtomic(dst, stat.Mode(), func(w io.Writer) error {
+		if cf.minify != "" {
+			return assetMinify.Minify(cf.minify, w, f)
+		}
+		_, err := io.Copy(w, f)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	// Preserve the modification time so that later builds can tell that
+	// the copy is up to date.
+	return os.Chtimes(dst, time.Time{}, stat.ModTime())
+}
+
+// writeFileAtomic creates the file name (and its parent directories, if
+// necessary) by calling write with a temp file and then renaming it into
+// place.
+func writeFileAtomic(name string, mode os.FileMode, write func(w io.Writer) error) error {
+	parent := filepath.Dir(name)
 	if err := os.MkdirAll(parent, 0o755); err != nil {
 		return err
 	}
-	tmp, err := tempFile(parent, filepath.Base(dst), stat.Mode())
+	tmp, err := tempFile(parent, filepath.Base(name), mode)
 	if err != nil {
 		return err
 	}
-	if _, err := io.Copy(tmp, f); err != nil {
+	if err := write(tmp); err != nil {
 		tmp.Close()
+		os.Remove(tmp.Name())
 		return err
 	}
 	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
 		return err
 	}
-	return os.Rename(tmp.Name(), dst)
+	return os.Rename(tmp.Name(), name)
 }
 
 func tempFile(dir, prefix string, mode os.FileMode) (*os.File, error) {
@@ -569,17 +1235,18 @@ func tempFile(dir, prefix string, mode os.FileMode) (*os.File, error) {
 	return nil, fmt.Errorf("could not create temp file after %d attempts", numAttempts)
 }
 
-func (s *sitkin) render() error {
-	// Delete and recreate the gen dir.
+// render writes the generated files. It stops early, returning ctx.Err(),
+// if ctx is canceled.
+func (s *sitkin) render(ctx context.Context) error {
+	// Rather than deleting the gen dir, we overwrite the files we generate
+	// (which lets unchanged assets be skipped) and remove everything else
+	// at the end.
 	genDir := filepath.Join(s.dir, "gen")
-	if err := os.RemoveAll(genDir); err != nil {
-		if !os.IsNotExist(err) {
-			return fmt.Errorf("cannot remove existing gen dir: %s", err)
-		}
-	}
-	if err := os.Mkdir(genDir, 0o755); err != nil {
+	if err := os.MkdirAll(genDir, 0o755); err != nil {
 		return fmt.Errorf("cannot create gen dir: %s", err)
 	}
+	s.outputs = make(map[string]struct{})
+	s.unchanged = make(map[string]struct{})
 
 	// Render markdown. We do this separately, before rendering the
 	// bottom-level templates, because they can access the data in the
@@ -588,35 +1255,47 @@ func (s *sitkin) render() error {
 	var buf bytes.Buffer
 	for _, fs := range s.fileSets {
 		for _, f := range fs.Files {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
 			buf.Reset()
 			if err := f.markdownTmpl.Execute(&buf, nil); err != nil {
 				return fmt.Errorf("error rendering markdown inside file set %q: %s", fs.name, err)
 			}
-			f.Contents = template.HTML(renderMarkdown(buf.Bytes()))
+			f.Contents = template.HTML(s.cache.renderMarkdown(buf.Bytes()))
 		}
 	}
 	for _, f := range s.markdownFiles {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 		buf.Reset()
 		if err := f.markdownTmpl.Execute(&buf, nil); err != nil {
 			return fmt.Errorf("error rendering markdown file %s: %s", f.Name, err)
 		}
-		f.Contents = template.HTML(renderMarkdown(buf.Bytes()))
+		f.Contents = template.HTML(s.cache.renderMarkdown(buf.Bytes()))
 	}
 
 	// Render file sets.
 	for _, fs := range s.fileSets {
-		if err := s.renderFileSet(fs); err != nil {
+		if err := s.renderFileSet(ctx, fs); err != nil {
 			return fmt.Errorf("error rendering file set %q: %s", fs.name, err)
 		}
 	}
 
 	// Render top-level templates.
 	for _, tf := range s.templateFiles {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 		if err := s.renderTemplate(tf); err != nil {
 			return fmt.Errorf("error rendering template %q: %s", tf.name, err)
 		}
 	}
 	for _, ttf := range s.textTemplateFiles {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 		if err := s.renderTextTemplate(ttf); err != nil {
 			return fmt.Errorf("error rendering text template %q: %s", ttf.name, err)
 		}
@@ -624,21 +1303,84 @@ func (s *sitkin) render() error {
 
 	// Render top-level markdown files.
 	for _, md := range s.markdownFiles {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 		if err := s.renderMarkdown(md); err != nil {
 			return fmt.Errorf("error rendering markdown file %q: %s", md.Name, err)
 		}
 	}
 
+	// Write redirect stubs.
+	if err := s.renderRedirects(genDir); err != nil {
+		return err
+	}
+
 	// Copy assets.
 	for _, cf := range s.copyFiles {
-		if err := cf.copy(s.dir, genDir); err != nil {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := s.copyAsset(cf, genDir); err != nil {
+			return err
+		}
+	}
+
+	// Write bundles.
+	for _, b := range s.bundles {
+		if err := s.addOutput(filepath.Join(genDir, b.dstPath)); err != nil {
 			return err
 		}
+		if err := b.write(genDir); err != nil {
+			return fmt.Errorf("error writing bundle %s: %s", b.name, err)
+		}
 	}
 
+	// Generate resized images.
+	for _, img := range s.images {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := s.renderImage(img, genDir); err != nil {
+			return fmt.Errorf("error resizing image %s: %s", img.srcPath, err)
+		}
+	}
+
+	// Write compressed copies of the output files.
+	if err := s.precompress(); err != nil {
+		return err
+	}
+
+	// Don't prune if the render was cut short.
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := s.pruneOutputs(genDir); err != nil {
+		return err
+	}
+	if err := s.cache.save(); err != nil {
+		return fmt.Errorf("error saving build cache: %s", err)
+	}
+	return nil
+}
+
+// addOutput records that the current render is writing the file name.
+func (s *sitkin) addOutput(name string) error {
+	if _, ok := s.outputs[name]; ok {
+		return fmt.Errorf("%s is generated more than once", name)
+	}
+	s.outputs[name] = struct{}{}
 	return nil
 }
 
+// createFile writes the generated file name using write.
+func (s *sitkin) createFile(name string, write func(w io.Writer) error) error {
+	if err := s.addOutput(name); err != nil {
+		return err
+	}
+	return writeFileAtomic(name, 0o644, write)
+}
+
 var markdownRenderer = goldmark.New(
 	goldmark.WithRendererOptions(goldmarkhtml.WithUnsafe()),
 	goldmark.WithExtensions(
@@ -656,101 +1398,80 @@ func renderMarkdown(input []byte) []byte {
 	return buf.Bytes()
 }
 
-func (s *sitkin) renderFileSet(fs *fileSet) error {
-	dir := filepath.Join(s.dir, "gen", fs.name)
-	if err := os.Mkdir(dir, 0o755); err != nil {
-		return err
-	}
+func (s *sitkin) renderFileSet(ctx context.Context, fs *fileSet) error {
 	for _, md := range fs.Files {
-		if err := s.renderFileSetMarkdown(dir, md); err != nil {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := s.renderFileSetMarkdown(md); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
-// context is the common context to all templates.
-type context struct {
+// tmplContext is the common context to all templates.
+type tmplContext struct {
 	DevMode  bool
+	Profile  string // selected with -env
 	FileSets map[string]*fileSet
+	Data     map[string]interface{} // from sitkin/data
+	Site     map[string]interface{} // from config.json and the environment
 }
 
-func (s *sitkin) renderFileSetMarkdown(dir string, md *markdownFile) error {
-	f, err := createFile(filepath.Join(dir, md.Name+".html"))
-	if err != nil {
-		return err
-	}
-	defer f.Close()
-	ctx := struct {
-		*context
+func (s *sitkin) renderFileSetMarkdown(md *markdownFile) error {
+	data := struct {
+		*tmplContext
 		*markdownFile
 	}{
-		context:      s.ctx,
+		tmplContext:  s.tmplCtx,
 		markdownFile: md,
 	}
 	var buf bytes.Buffer
-	if err := md.tmpl.Execute(&buf, ctx); err != nil {
-		return err
-	}
-	if err := minifyHTML(f, &buf); err != nil {
+	if err := md.tmpl.Execute(&buf, data); err != nil {
 		return err
 	}
-	return f.Close()
+	return s.createFile(filepath.Join(s.dir, "gen", md.outPath), func(w io.Writer) error {
+		return minifyHTML(w, &buf)
+	})
 }
 
 func (s *sitkin) renderTemplate(tf *templateFile) error {
-	f, err := createFile(filepath.Join(s.dir, "gen", tf.name+".html"))
-	if err != nil {
-		return err
-	}
-	defer f.Close()
 	var buf bytes.Buffer
-	if err := tf.tmpl.Execute(&buf, s.ctx); err != nil {
-		return err
-	}
-	if err := minifyHTML(f, &buf); err != nil {
+	if err := tf.tmpl.Execute(&buf, s.tmplCtx); err != nil {
 		return err
 	}
-	return f.Close()
+	return s.createFile(filepath.Join(s.dir, "gen", tf.outPath), func(w io.Writer) error {
+		return minifyHTML(w, &buf)
+	})
 }
 
 func (s *sitkin) renderTextTemplate(ttf *textTemplateFile) error {
-	f, err := createFile(filepath.Join(s.dir, "gen", ttf.name))
-	if err != nil {
+	var buf bytes.Buffer
+	if err := ttf.tmpl.Execute(&buf, s.tmplCtx); err != nil {
 		return err
 	}
-	defer f.Close()
-	if err := ttf.tmpl.Execute(f, s.ctx); err != nil {
+	return s.createFile(filepath.Join(s.dir, "gen", ttf.name), func(w io.Writer) error {
+		_, err := w.Write(buf.Bytes())
 		return err
-	}
-	return f.Close()
+	})
 }
 
 func (s *sitkin) renderMarkdown(md *markdownFile) error {
-	f, err := createFile(filepath.Join(s.dir, "gen", md.Name+".html"))
-	if err != nil {
-		return err
-	}
-	defer f.Close()
-	ctx := struct {
-		*context
+	data := struct {
+		*tmplContext
 		*markdownFile
 	}{
-		context:      s.ctx,
+		tmplContext:  s.tmplCtx,
 		markdownFile: md,
 	}
 	var buf bytes.Buffer
-	if err := md.tmpl.Execute(&buf, ctx); err != nil {
-		return err
-	}
-	if err := minifyHTML(f, &buf); err != nil {
+	if err := md.tmpl.Execute(&buf, data); err != nil {
 		return err
 	}
-	return f.Close()
-}
-
-func createFile(name string) (*os.File, error) {
-	return os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	return s.createFile(filepath.Join(s.dir, "gen", md.outPath), func(w io.Writer) error {
+		return minifyHTML(w, &buf)
+	})
 }
 
 var defaultMinify = minify.New()
@@ -764,6 +1485,14 @@ func main() {
 	devAddr := flag.String("devaddr", "", `If given, operate in dev mode: serve at this HTTP address,
 open it in a browser window, and rebuild files when they change`)
 	verbose := flag.Bool("v", false, "Verbose mode")
+	noCache := flag.Bool("nocache", false, "Don't use or update the build cache")
+	profile := flag.String("env", "", "Build using this profile from config.json")
+	devTLS := flag.Bool("devtls", false, `In dev mode, serve HTTPS using a self-signed certificate
+(saved in the .sitkin-cache directory)`)
+	openFlag := flag.Bool("open", true, "In dev mode, open the site in a browser window")
+	browser := flag.String("browser", "", `Command for opening a browser window in dev mode; the URL
+is appended or substituted for %s (default: $BROWSER, or
+the system's default browser)`)
 	flag.Usage = func() {
 		fmt.Fprint(os.Stderr, `Usage:
 
@@ -790,18 +1519,48 @@ If dir is not given, then the current directory is used.
 		os.Exit(1)
 	}
 
-	if *devAddr == "" {
-		build(dir, false, *verbose)
+	opts := options{
+		devMode: *devAddr != "",
+		verbose: *verbose,
+		noCache: *noCache,
+		profile: *profile,
+	}
+	if !opts.devMode {
+		build(context.Background(), dir, opts, nil)
 		return
 	}
 
 	// Dev mode. Serve HTTP, open up a browser window, rebuild files on change.
 	// Start by building once, synchronously.
-	build(dir, true, *verbose)
+	ds := newDevServer(filepath.Join(dir, "gen"))
+	var prev *sitkin
+	doBuild := func(ctx context.Context, changes []change) error {
+		if opts.verbose && len(changes) > 0 {
+			log.Printf("Rebuilding after %d changes:", len(changes))
+			for _, c := range changes {
+				log.Printf("  %s", c)
+			}
+		}
+		if prev != nil && needsFullReload(dir, changes) {
+			prev = nil
+		}
+		s, err := build(ctx, dir, opts, prev)
+		if err != nil {
+			if ctx.Err() == nil {
+				ds.fail(err)
+			}
+			return err
+		}
+		ds.update(s)
+		prev = s
+		return nil
+	}
+	doBuild(context.Background(), nil)
 
+	rb := newRebuilder(doBuild)
+	go rb.run()
 	go func() {
-		doBuild := func() { build(dir, true, *verbose) }
-		if err := watchDir(dir, 500*time.Millisecond, doBuild, "gen"); err != nil {
+		if err := watchDir(dir, opts.profile, 500*time.Millisecond, rb.changed, "gen", cacheDirName); err != nil {
 			log.Fatalln("Error watching project dir for changes:", err)
 		}
 	}()
@@ -810,55 +1569,96 @@ If dir is not given, then the current directory is used.
 	if err != nil {
 		log.Fatalln("Cannot listen on selected address:", err)
 	}
+	scheme := "http"
+	client := http.DefaultClient
+	ips := lanIPs()
+	if *devTLS {
+		cfg, err := devTLSConfig(dir, ips)
+		if err != nil {
+			log.Fatalln("Cannot set up TLS for the dev server:", err)
+		}
+		ln = tls.NewListener(ln, cfg)
+		scheme = "https"
+		client = &http.Client{
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{InsecureSkipVerify: true}, // self-signed
+			},
+		}
+	}
+	urls := devURLs(scheme, ln.Addr(), ips)
+	for _, u := range urls {
+		log.Println("Serving at", u)
+	}
 
-	go func() {
-		// Wait for the server to start before opening a browser window.
-		u := "http://" + ln.Addr().String()
-		var ok bool
-		start := time.Now()
-		const maxWait = time.Second
-		for delay := time.Millisecond; time.Since(start) < maxWait; delay *= 2 {
-			resp, err := http.Get(u)
-			if err != nil {
-				continue
+	if *openFlag {
+		go func() {
+			// Wait for the server to start before opening a browser window.
+			u := urls[0]
+			const maxWait = 5 * time.Second
+			if err := waitForServer(client, u, maxWait); err != nil {
+				log.Printf("After waiting %s, no response from %s: %s", maxWait, u, err)
+				return
 			}
-			resp.Body.Close()
-			if resp.StatusCode == 200 {
-				ok = true
-				break
+			if err := openBrowser(*browser, u); err != nil {
+				log.Println("Error opening browser:", err)
 			}
+		}()
+	}
+
+	log.Fatal(http.Serve(ln, ds))
+}
+
+// waitForServer polls u until the server responds (with any status) or
+// maxWait elapses.
+func waitForServer(client *http.Client, u string, maxWait time.Duration) error {
+	deadline := time.Now().Add(maxWait)
+	delay := 10 * time.Millisecond
+	for {
+		resp, err := client.Get(u)
+		if err == nil {
+			resp.Body.Close()
+			return nil
 		}
-		if !ok {
-			log.Printf("After waiting %s, no content served at %s", maxWait, u)
-			return
+		if time.Now().Add(delay).After(deadline) {
+			return err
 		}
-		if err := openBrowser(u); err != nil {
-			log.Println("Error opening browser:", err)
+		time.Sleep(delay)
+		if delay < 500*time.Millisecond {
+			delay *= 2
 		}
-	}()
-
-	fs := http.FileServer(http.Dir(filepath.Join(dir, "gen")))
-	log.Fatal(http.Serve(ln, fs))
+	}
 }
 
-func build(dir string, devMode, verbose bool) {
+// build loads and renders the project in dir, reusing the templates of prev
+// if it is non-nil (see reload). Outside of dev mode, it exits if the build
+// fails. If ctx is canceled, build stops early and returns ctx.Err().
+func build(ctx context.Context, dir string, opts options, prev *sitkin) (*sitkin, error) {
 	start := time.Now()
-	s, err := load(dir, devMode, verbose)
+	s, err := reload(ctx, dir, opts, prev)
 	if err != nil {
+		if ctx.Err() != nil {
+			log.Println("Build canceled")
+			return nil, ctx.Err()
+		}
 		log.Println("Error loading sitkin project:", err)
-		if !devMode {
+		if !opts.devMode {
 			os.Exit(1)
 		}
-		return
+		return nil, fmt.Errorf("error loading sitkin project: %s", err)
 	}
-	if err := s.render(); err != nil {
+	if err := s.render(ctx); err != nil {
+		if ctx.Err() != nil {
+			log.Println("Build canceled")
+			return nil, ctx.Err()
+		}
 		log.Println("Error rendering sitkin project:", err)
-		if !devMode {
+		if !opts.devMode {
 			os.Exit(1)
 		}
-		return
+		return nil, fmt.Errorf("error rendering sitkin project: %s", err)
 	}
 	log.Println("Successfully built in", niceDuration(time.Since(start)))
+	return s, nil
 }
 
 func niceDuration(d time.Duration) string {
@@ -885,19 +1685,47 @@ func niceDuration(d time.Duration) string {
 	}
 }
 
-func openBrowser(url string) error {
-	var tool string
-	switch runtime.GOOS {
-	case "darwin":
-		tool = "open"
-	case "linux":
-		tool = "xdg-open"
-	default:
-		return fmt.Errorf("don't know to to open a browser window on GOOS %q", runtime.GOOS)
+// openBrowser opens url using the command browser. If browser is empty,
+// $BROWSER is used, and if that's empty too, the system's default browser.
+func openBrowser(browser, url string) error {
+	if browser == "" {
+		browser = os.Getenv("BROWSER")
+	}
+	var args []string
+	if strings.TrimSpace(browser) != "" {
+		args = browserArgs(browser, url)
+	} else {
+		switch runtime.GOOS {
+		case "darwin":
+			args = []string{"open", url}
+		case "linux", "freebsd", "openbsd", "netbsd":
+			args = []string{"xdg-open", url}
+		case "windows":
+			args = []string{"rundll32", "url.dll,FileProtocolHandler", url}
+		default:
+			return fmt.Errorf("don't know how to open a browser window on GOOS %q", runtime.GOOS)
+		}
 	}
 
-	cmd := exec.Command(tool, url)
+	cmd := exec.Command(args[0], args[1:]...)
 	cmd.Stderr = os.Stderr
 	cmd.Stdout = os.Stdout
 	return cmd.Run()
 }
+
+// browserArgs splits the browser command browser into arguments and adds
+// url: it replaces any %s in the arguments or, if there is none, is appended.
+func browserArgs(browser, url string) []string {
+	args := strings.Fields(browser)
+	substituted := false
+	for i, arg := range args {
+		if strings.Contains(arg, "%s") {
+			args[i] = strings.ReplaceAll(arg, "%s", url)
+			substituted = true
+		}
+	}
+	if !substituted {
+		args = append(args, url)
+	}
+	return args
+}
@@ -1,7 +1,11 @@
 package main
 
 import (
+	"context"
 	"crypto/sha256"
+	"fmt"
+	"net"
+	"net/http"
 	"os"
 	"path/filepath"
 	"reflect"
@@ -43,6 +47,49 @@ func TestNiceDuration(t *testing.T) {
 	}
 }
 
+func TestBrowserArgs(t *testing.T) {
+	const u = "http://localhost:8080"
+	for _, tt := range []struct {
+		browser string
+		want    []string
+	}{
+		{"firefox", []string{"firefox", u}},
+		{"chromium --new-window", []string{"chromium", "--new-window", u}},
+		{"open -a Safari %s --background", []string{"open", "-a", "Safari", u, "--background"}},
+		{"echo url=%s", []string{"echo", "url=" + u}},
+	} {
+		if got := browserArgs(tt.browser, u); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("browserArgs(%q): got %q; want %q", tt.browser, got, tt.want)
+		}
+	}
+}
+
+func TestWaitForServer(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	u := "http://" + ln.Addr().String()
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		http.Serve(ln, http.NotFoundHandler())
+	}()
+	if err := waitForServer(http.DefaultClient, u, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	ln2, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u2 := "http://" + ln2.Addr().String()
+	ln2.Close()
+	if err := waitForServer(http.DefaultClient, u2, 100*time.Millisecond); err == nil {
+		t.Fatal("waitForServer succeeded with no server")
+	}
+}
+
 func TestCopyFiles(t *testing.T) {
 	td := newTempDir(t)
 	defer td.remove()
@@ -163,6 +210,33 @@ func hashBase62(s string) string {
 	return base62Hash(h[:8])
 }
 
+func TestSymlinks(t *testing.T) {
+	td := newTempDir(t)
+	defer td.remove()
+
+	td.writeFile("site/sitkin/default.tmpl", "")
+	td.writeFile("shared/css/x.css", "x")
+	if err := os.Symlink(td.path("shared"), td.path("site/shared")); err != nil {
+		t.Fatal(err)
+	}
+	s, err := load(td.path("site"), options{})
+	if err != nil {
+		t.Fatal("load failed:", err)
+	}
+	if err := s.render(context.Background()); err != nil {
+		t.Fatal("render failed:", err)
+	}
+	td.checkFile(filepath.Join("site/gen", s.hashAssets["/shared/css/x.css"]), "x")
+
+	if err := os.Symlink("..", td.path("shared/css/loop")); err != nil {
+		t.Fatal(err)
+	}
+	_, err = load(td.path("site"), options{})
+	if err == nil || !strings.Contains(err.Error(), "symlink cycle") {
+		t.Fatalf("load: got err %v; want symlink cycle error", err)
+	}
+}
+
 func TestSitkin(t *testing.T) {
 	td := newTempDir(t)
 	defer td.remove()
@@ -230,11 +304,11 @@ func TestSitkin(t *testing.T) {
 	td.writeFile("x.ignore", "ignore me")
 	td.writeFile("favicon.ico", "favicon")
 
-	s, err := load(td.dir, false, false)
+	s, err := load(td.dir, options{})
 	if err != nil {
 		t.Fatal("load failed:", err)
 	}
-	if err := s.render(); err != nil {
+	if err := s.render(context.Background()); err != nil {
 		t.Fatal("render failed:", err)
 	}
 
@@ -258,6 +332,569 @@ func TestSitkin(t *testing.T) {
 	td.checkFile("gen/favicon.ico", "favicon")
 }
 
+func TestMinifyAndBundles(t *testing.T) {
+	td := newTempDir(t)
+	defer td.remove()
+
+	td.writeFile(
+		"sitkin/config.json",
+		`{
+  "ignore": ["src"],
+  "minify": ["text/css", "application/javascript"],
+  "bundles": {
+    "/assets/all.css": ["src/a.css", "src/b.css"]
+  }
+}`,
+	)
+	td.writeFile(
+		"sitkin/default.tmpl",
+		`<link href="{{link "/assets/all.css"}}" rel="stylesheet">`,
+	)
+	td.writeFile("index.tmpl", "")
+	td.writeFile("src/a.css", "a {\n  color: red;\n}")
+	td.writeFile("src/b.css", "b {\n  color: blue;\n}\n")
+	td.writeFile("assets/x.js", "var x = 1 + 2;\n")
+	td.writeFile("assets/y.svg", "<svg  ></svg>\n")
+
+	for _, devMode := range []bool{false, true} {
+		s, err := load(td.dir, options{devMode: devMode})
+		if err != nil {
+			t.Fatal("load failed:", err)
+		}
+		if err := s.render(context.Background()); err != nil {
+			t.Fatal("render failed:", err)
+		}
+		if devMode {
+			td.checkFile("gen/assets/all.NOHASH.css", "a {\n  color: red;\n}\nb {\n  color: blue;\n}\n")
+			td.checkFile("gen/assets/x.NOHASH.js", "var x = 1 + 2;\n")
+			continue
+		}
+		bundle := "/assets/all." + hashBase62("a {\n  color: red;\n}\nb {\n  color: blue;\n}\n") + ".css"
+		td.checkFile("gen/index.html", "<link href="+bundle+" rel=stylesheet>")
+		td.checkFile("gen"+bundle, "a{color:red}b{color:blue}")
+		td.checkFile("gen/assets/x."+hashBase62("var x = 1 + 2;\n")+".js", "var x=1+2")
+		td.checkFile("gen/assets/y."+hashBase62("<svg  ></svg>\n")+".svg", "<svg  ></svg>\n")
+		td.checkNotExist("gen/src")
+	}
+}
+
+func TestPrettyURLs(t *testing.T) {
+	for _, tt := range []struct {
+		prettyURLs bool
+		files      map[string]string
+	}{
+		{
+			prettyURLs: false,
+			files: map[string]string{
+				"gen/index.html":             "<a href=/posts/hello-world.html>Hello</a><a href=/about.html>About</a>",
+				"gen/posts/hello-world.html": "/posts/hello-world.html",
+				"gen/about.html":             "/about.html",
+				"gen/contact.html":           "contact",
+				"gen/404.html":               "404",
+			},
+		},
+		{
+			prettyURLs: true,
+			files: map[string]string{
+				"gen/index.html":                   "<a href=/posts/hello-world/>Hello</a><a href=/about/>About</a>",
+				"gen/posts/hello-world/index.html": "/posts/hello-world/",
+				"gen/about/index.html":             "/about/",
+				"gen/contact/index.html":           "contact",
+				"gen/404.html":                     "404",
+			},
+		},
+	} {
+		td := newTempDir(t)
+		defer td.remove()
+
+		td.writeFile("sitkin/config.json", fmt.Sprintf(`{"filesets": ["posts"], "prettyURLs": %t}`, tt.prettyURLs))
+		td.writeFile("sitkin/default.tmpl", `{{block "contents" .}}{{.Permalink}}{{end}}`)
+		td.writeFile("sitkin/posts.tmpl", "")
+		td.writeFile("posts/2018-03-05.hello-world.md", "# Hello")
+		td.writeFile(
+			"index.tmpl",
+			`{{define "contents"}}{{range .FileSets.posts.Files}}<a href="{{.Permalink}}">Hello</a>{{end}}<a href="{{pageURL "/about"}}">About</a>{{end}}`,
+		)
+		td.writeFile("about.md", "# About")
+		td.writeFile("contact.tmpl", `{{define "contents"}}contact{{end}}`)
+		td.writeFile("404.tmpl", `{{define "contents"}}404{{end}}`)
+
+		s, err := load(td.dir, options{})
+		if err != nil {
+			t.Fatal("load failed:", err)
+		}
+		if err := s.render(context.Background()); err != nil {
+			t.Fatal("render failed:", err)
+		}
+		for name, contents := range tt.files {
+			td.checkFile(name, contents)
+		}
+	}
+}
+
+func TestReload(t *testing.T) {
+	td := newTempDir(t)
+	defer td.remove()
+
+	td.writeFile("sitkin/default.tmpl", `{{block "contents" .}}{{end}} {{link "/a.css"}}`)
+	td.writeFile("index.tmpl", `{{define "contents"}}index{{end}}`)
+	td.writeFile("a.css", "a")
+
+	prev, err := build(context.Background(), td.dir, options{noCache: true}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	td.checkFile("gen/index.html", "index "+prev.hashAssets["/a.css"])
+
+	// With prev, the templates are reused (so this change is not noticed)
+	// but the functions use the new build's asset hashes.
+	td.writeFile("sitkin/default.tmpl", `changed`)
+	td.writeFile("index.tmpl", `{{define "contents"}}new index{{end}}`)
+	td.writeFile("a.css", "b")
+	s, err := build(context.Background(), td.dir, options{noCache: true}, prev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.hashAssets["/a.css"] == prev.hashAssets["/a.css"] {
+		t.Fatal("asset hash did not change")
+	}
+	td.checkFile("gen/index.html", "new index "+s.hashAssets["/a.css"])
+
+	if _, err := build(context.Background(), td.dir, options{noCache: true}, nil); err != nil {
+		t.Fatal(err)
+	}
+	td.checkFile("gen/index.html", "changed")
+}
+
+func TestPartials(t *testing.T) {
+	td := newTempDir(t)
+	defer td.remove()
+
+	td.writeFile("sitkin/config.json", `{"filesets": ["posts"]}`)
+	td.writeFile("sitkin/default.tmpl", `{{template "header" "Site"}}{{block "contents" .}}{{end}}`)
+	td.writeFile("sitkin/posts.tmpl", `{{define "contents"}}{{partial "cards/post" .}}{{end}}`)
+	td.writeFile("sitkin/partials/header.tmpl", `<h1>{{.}}</h1>`)
+	td.writeFile("sitkin/partials/cards/post.tmpl", `<div>{{partial "header" .Name}}</div>`)
+	td.writeFile("posts/2018-03-05.hello.md", "# Hello")
+	td.writeFile("index.tmpl", `{{define "contents"}}{{partial "header" "Index"}}{{end}}`)
+
+	s, err := load(td.dir, options{})
+	if err != nil {
+		t.Fatal("load failed:", err)
+	}
+	if err := s.render(context.Background()); err != nil {
+		t.Fatal("render failed:", err)
+	}
+	td.checkFile("gen/index.html", "<h1>Site</h1><h1>Index</h1>")
+	td.checkFile("gen/posts/hello.html", "<h1>Site</h1><div><h1>hello</h1></div>")
+
+	td.writeFile("index.tmpl", `{{define "contents"}}{{partial "footer" .}}{{end}}`)
+	s, err = load(td.dir, options{})
+	if err != nil {
+		t.Fatal("load failed:", err)
+	}
+	err = s.render(context.Background())
+	if err == nil || !strings.Contains(err.Error(), `no partial named "footer"`) {
+		t.Fatalf("render: got err %v; want missing partial error", err)
+	}
+}
+
+func TestLayouts(t *testing.T) {
+	td := newTempDir(t)
+	defer td.remove()
+
+	td.writeFile("sitkin/config.json", `{"filesets": ["posts"], "layouts": {"posts": "article"}}`)
+	td.writeFile("sitkin/default.tmpl", `<main>{{block "contents" .}}{{end}}</main>`)
+	td.writeFile("sitkin/article.tmpl", `{{define "contents"}}<article>{{block "body" .}}{{.Contents}}{{end}}</article>{{end}}`)
+	td.writeFile("sitkin/posts.tmpl", `{{define "body"}}<h1>{{.Name}}</h1>{{.Contents}}{{end}}`)
+	td.writeFile("sitkin/wide.tmpl", "{{/* parent: article */}}\n"+`{{define "contents"}}<div>{{.Contents}}</div>{{end}}`)
+	td.writeFile("posts/2018-03-05.hello.md", "hello")
+	td.writeFile("posts/2018-03-06.big.md", "<!--\n"+`{"layout": "wide"}`+"\n-->\nbig")
+	td.writeFile("about.md", "<!--\n"+`{"layout": "article"}`+"\n-->\nabout")
+	td.writeFile("index.tmpl", `{{- /* parent: article */ -}}{{define "body"}}index{{end}}`)
+
+	s, err := load(td.dir, options{})
+	if err != nil {
+		t.Fatal("load failed:", err)
+	}
+	if err := s.render(context.Background()); err != nil {
+		t.Fatal("render failed:", err)
+	}
+	td.checkFile("gen/posts/hello.html", "<main><article><h1>hello</h1><p>hello</article></main>")
+	td.checkFile("gen/posts/big.html", "<main><div><p>big</div></main>")
+	td.checkFile("gen/about.html", "<main><article><p>about</article></main>")
+	td.checkFile("gen/index.html", "<main><article>index</article></main>")
+
+	for _, tt := range []struct {
+		files   map[string]string
+		wantErr string
+	}{
+		{
+			files: map[string]string{
+				"sitkin/a.tmpl": "{{/* parent: b */}}",
+				"sitkin/b.tmpl": "{{/* parent: a */}}",
+			},
+			wantErr: "template parents form a cycle: a -> b -> a",
+		},
+		{
+			files:   map[string]string{"sitkin/a.tmpl": "{{/* parent: nope */}}"},
+			wantErr: "template a has unknown parent nope",
+		},
+		{
+			files:   map[string]string{"sitkin/config.json": `{"layouts": {"nope": "default"}}`},
+			wantErr: "parent given for unknown template nope",
+		},
+		{
+			files:   map[string]string{"about.md": "<!--\n" + `{"layout": "nope"}` + "\n-->\n"},
+			wantErr: "unknown layout nope",
+		},
+	} {
+		td := newTempDir(t)
+		defer td.remove()
+		td.writeFile("sitkin/default.tmpl", "")
+		for name, contents := range tt.files {
+			td.writeFile(name, contents)
+		}
+		_, err := load(td.dir, options{})
+		if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("load with %q: got err %v; want %q", tt.files, err, tt.wantErr)
+		}
+	}
+}
+
+func TestData(t *testing.T) {
+	td := newTempDir(t)
+	defer td.remove()
+
+	td.writeFile("sitkin/config.json", `{"filesets": ["posts"]}`)
+	td.writeFile("sitkin/default.tmpl", `{{.Data.site.title}}|{{block "contents" .}}{{end}}`)
+	td.writeFile("sitkin/posts.tmpl", `{{define "contents"}}{{.Data.authors.jane.name}}{{end}}`)
+	td.writeFile("sitkin/data/site.json", `{"title": "My Site"}`)
+	td.writeFile("sitkin/data/authors/jane.yaml", "name: Jane\nposts: 3\n")
+	td.writeFile("sitkin/data/talks.csv", "title,year\nGo,2018\nRust,2019\n")
+	td.writeFile("posts/2018-03-05.hello.md", "hello")
+	td.writeFile("index.tmpl", `{{define "contents"}}{{range .Data.talks}}{{.title}} ({{.year}}),{{end}}{{.Data.authors.jane.posts}}{{end}}`)
+
+	s, err := load(td.dir, options{})
+	if err != nil {
+		t.Fatal("load failed:", err)
+	}
+	if err := s.render(context.Background()); err != nil {
+		t.Fatal("render failed:", err)
+	}
+	td.checkFile("gen/index.html", "My Site|Go (2018),Rust (2019),3")
+	td.checkFile("gen/posts/hello.html", "My Site|Jane")
+
+	td.writeFile("sitkin/data/site.yml", "title: Other\n")
+	if _, err := load(td.dir, options{}); err == nil || !strings.Contains(err.Error(), "have the same name") {
+		t.Fatalf("load: got err %v; want duplicate data error", err)
+	}
+	if err := os.Remove(td.path("sitkin/data/site.yml")); err != nil {
+		t.Fatal(err)
+	}
+	td.writeFile("sitkin/data/authors.json", "{}")
+	if _, err := load(td.dir, options{}); err == nil || !strings.Contains(err.Error(), "both a file and a directory") {
+		t.Fatalf("load: got err %v; want file/directory data error", err)
+	}
+}
+
+func TestSiteParams(t *testing.T) {
+	site := map[string]interface{}{
+		"title":   "My Site",
+		"baseURL": "https://example.com",
+		"posts":   3.0,
+		"noindex": true,
+	}
+	for _, tt := range []struct {
+		env  []string
+		want map[string]interface{}
+	}{
+		{
+			env:  nil,
+			want: site,
+		},
+		{
+			env: []string{
+				"HOME=/root",
+				"SITKIN_SITE_BASEURL=https://staging.example.com",
+				"SITKIN_SITE_ANALYTICSID=UA-1",
+				"SITKIN_SITE_NOINDEX=false",
+				"SITKIN_SITE_POSTS=5",
+				"SITKIN_SITE_=x",
+				"SITKIN_TITLE=x",
+			},
+			want: map[string]interface{}{
+				"title":       "My Site",
+				"baseURL":     "https://staging.example.com",
+				"posts":       5.0,
+				"noindex":     false,
+				"analyticsid": "UA-1",
+			},
+		},
+		{
+			env: []string{"SITKIN_SITE_TITLE=false"},
+			want: map[string]interface{}{
+				"title":   "false",
+				"baseURL": "https://example.com",
+				"posts":   3.0,
+				"noindex": true,
+			},
+		},
+	} {
+		got, err := siteParams(site, tt.env)
+		if err != nil {
+			t.Errorf("siteParams(%q): %s", tt.env, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("siteParams(%q): got %v; want %v", tt.env, got, tt.want)
+		}
+	}
+	if site["baseURL"] != "https://example.com" {
+		t.Error("siteParams modified the config")
+	}
+	_, err := siteParams(site, []string{"SITKIN_SITE_NOINDEX=no"})
+	if err == nil || !strings.Contains(err.Error(), "SITKIN_SITE_NOINDEX") {
+		t.Errorf("siteParams with a bad bool: got err %v; want an error", err)
+	}
+}
+
+func TestSite(t *testing.T) {
+	td := newTempDir(t)
+	defer td.remove()
+
+	td.writeFile("sitkin/config.json", `{"site": {"title": "My Site", "baseURL": "https://example.com", "noindex": true}}`)
+	td.writeFile("sitkin/default.tmpl", `{{if .Site.noindex}}noindex|{{end}}{{.Site.title}}|{{block "contents" .}}{{end}}`)
+	td.writeFile("index.tmpl", `{{define "contents"}}{{.Site.baseURL}}{{end}}`)
+	td.writeFile("about.md", "about")
+	td.writeFile("feed.xml.tpl", `<feed>{{.Site.baseURL}}</feed>`)
+	t.Setenv("SITKIN_SITE_BASEURL", "https://staging.example.com")
+	t.Setenv("SITKIN_SITE_NOINDEX", "false")
+
+	s, err := load(td.dir, options{})
+	if err != nil {
+		t.Fatal("load failed:", err)
+	}
+	if err := s.render(context.Background()); err != nil {
+		t.Fatal("render failed:", err)
+	}
+	td.checkFile("gen/index.html", "My Site|https://staging.example.com")
+	td.checkFile("gen/about.html", "My Site|")
+	td.checkFile("gen/feed.xml", "<feed>https://staging.example.com</feed>")
+}
+
+func TestProfiles(t *testing.T) {
+	td := newTempDir(t)
+	defer td.remove()
+
+	td.writeFile("sitkin/config.json", `{
+  "filesets": ["posts"],
+  "nohash": ["style.css"],
+  "minify": ["text/css"],
+  "site": {"title": "My Site", "baseURL": "https://example.com"},
+  "profiles": {
+    "staging": {
+      "site": {"baseURL": "https://staging.example.com"},
+      "ignore": ["notes"],
+      "drafts": true,
+      "minify": []
+    }
+  }
+}`)
+	td.writeFile("sitkin/default.tmpl", `{{.Profile}}|{{.Site.title}}|{{.Site.baseURL}}|{{block "contents" .}}{{end}}`)
+	td.writeFile("sitkin/posts.tmpl", `{{define "contents"}}{{.Name}}{{end}}`)
+	td.writeFile("index.tmpl", `{{define "contents"}}{{range .FileSets.posts.Files}}{{.Name}},{{end}}{{end}}`)
+	td.writeFile("posts/2018-03-05.hello.md", "hello")
+	td.writeFile("posts/2018-03-06.wip.md", "<!--\n"+`{"draft": true}`+"\n-->\nwip")
+	td.writeFile("plans.md", "<!--\n"+`{"draft": true}`+"\n-->\nplans")
+	td.writeFile("notes/a.html", "a")
+	td.writeFile("style.css", "a {\n  color: red;\n}\n")
+
+	build := func(profile string) {
+		t.Helper()
+		s, err := load(td.dir, options{profile: profile})
+		if err != nil {
+			t.Fatal("load failed:", err)
+		}
+		if err := s.render(context.Background()); err != nil {
+			t.Fatal("render failed:", err)
+		}
+	}
+
+	build("")
+	td.checkFile("gen/index.html", "|My Site|https://example.com|hello,")
+	td.checkNotExist("gen/posts/wip.html")
+	td.checkNotExist("gen/plans.html")
+	td.checkFile("gen/notes/a.html", "a")
+	td.checkFile("gen/style.css", "a{color:red}")
+
+	build("staging")
+	td.checkFile("gen/index.html", "staging|My Site|https://staging.example.com|wip,hello,")
+	td.checkFile("gen/posts/wip.html", "staging|My Site|https://staging.example.com|wip")
+	td.checkFile("gen/plans.html", "staging|My Site|https://staging.example.com|")
+	td.checkNotExist("gen/notes/a.html")
+	td.checkFile("gen/style.css", "a {\n  color: red;\n}\n")
+
+	if _, err := load(td.dir, options{profile: "prod"}); err == nil || !strings.Contains(err.Error(), `unknown profile "prod"`) {
+		t.Fatalf("load: got err %v; want unknown profile error", err)
+	}
+}
+
+func TestPermalinks(t *testing.T) {
+	td := newTempDir(t)
+	defer td.remove()
+
+	td.writeFile(
+		"sitkin/config.json",
+		`{
+  "filesets": ["posts", "notes"],
+  "permalinks": {
+    "posts": "/:year/:month/:day/:slug/",
+    "notes": "/:fileset/:category/:slug"
+  }
+}`,
+	)
+	td.writeFile("sitkin/default.tmpl", `{{block "contents" .}}{{.Permalink}}{{end}}`)
+	td.writeFile("sitkin/posts.tmpl", "")
+	td.writeFile("sitkin/notes.tmpl", "")
+	td.writeFile("posts/2018-03-05.hello-world.md", "")
+	td.writeFile("notes/2019-12-31.go-tips.md", "<!--\n{\"category\": \"Programming Languages\"}\n-->\n")
+	td.writeFile("notes/2020-01-01.go-1.5-released.md", "<!--\n{\"category\": \"News\"}\n-->\n")
+
+	s, err := load(td.dir, options{})
+	if err != nil {
+		t.Fatal("load failed:", err)
+	}
+	if err := s.render(context.Background()); err != nil {
+		t.Fatal("render failed:", err)
+	}
+	td.checkFile("gen/2018/03/05/hello-world/index.html", "/2018/03/05/hello-world/")
+	td.checkFile("gen/notes/programming-languages/go-tips.html", "/notes/programming-languages/go-tips")
+	// The dots in the slug aren't an extension.
+	td.checkFile("gen/notes/news/go-1.5-released.html", "/notes/news/go-1.5-released")
+	td.checkNotExist("gen/notes/news/go-1.5-released")
+
+	td.writeFile("notes/2020-01-02.more.md", "")
+	if _, err := load(td.dir, options{}); err == nil || !strings.Contains(err.Error(), `no metadata key "category"`) {
+		t.Errorf("got load error %v; want missing metadata key error", err)
+	}
+}
+
+func TestRedirects(t *testing.T) {
+	td := newTempDir(t)
+	defer td.remove()
+
+	td.writeFile(
+		"sitkin/config.json",
+		`{
+  "filesets": ["posts"],
+  "redirects": {"/feed": "/feed.xml"},
+  "redirectFile": "netlify"
+}`,
+	)
+	td.writeFile("sitkin/default.tmpl", "")
+	td.writeFile("sitkin/posts.tmpl", "")
+	td.writeFile(
+		"posts/2018-03-05.hello-world.md",
+		"<!--\n{\"aliases\": [\"/posts/hello.html\", \"/hello/\", \"/releases/1.5\"]}\n-->\n",
+	)
+
+	s, err := load(td.dir, options{})
+	if err != nil {
+		t.Fatal("load failed:", err)
+	}
+	if err := s.render(context.Background()); err != nil {
+		t.Fatal("render failed:", err)
+	}
+	b, err := os.ReadFile(td.path("gen/posts/hello.html"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `<meta http-equiv="refresh" content="0; url=/posts/hello-world.html">`; !strings.Contains(string(b), want) {
+		t.Errorf("redirect stub does not contain %s:\n%s", want, b)
+	}
+	// The dot in /releases/1.5 isn't an extension.
+	for _, name := range []string{"gen/hello/index.html", "gen/feed.html", "gen/releases/1.5.html"} {
+		if _, err := os.Stat(td.path(name)); err != nil {
+			t.Error(err)
+		}
+	}
+	td.checkNotExist("gen/releases/1.5")
+	td.checkFile(
+		"gen/_redirects",
+		"/feed /feed.xml 301\n/hello/ /posts/hello-world.html 301\n/posts/hello.html /posts/hello-world.html 301\n"+
+			"/releases/1.5 /posts/hello-world.html 301\n",
+	)
+
+	td.writeFile("posts/2018-04-01.hello.md", "")
+	_, err = load(td.dir, options{})
+	if want := "output path collision: posts/hello.html is generated by alias in posts/2018-03-05.hello-world.md from /posts/hello.html, posts/2018-04-01.hello.md"; err == nil || err.Error() != want {
+		t.Errorf("got load error %v; want %q", err, want)
+	}
+}
+
+func TestOutputCollisions(t *testing.T) {
+	td := newTempDir(t)
+	defer td.remove()
+
+	td.writeFile("sitkin/config.json", `{"nohash": ["*.css"]}`)
+	td.writeFile("sitkin/default.tmpl", "")
+	td.writeFile("about.md", "")
+	td.writeFile("about.tmpl", "")
+	td.writeFile("about.html", "")
+	td.writeFile("feed.tpl", "")
+	td.writeFile("feed", "")
+	td.writeFile("x.css", "")
+
+	_, err := load(td.dir, options{})
+	want := `2 output path collisions:
+	about.html is generated by about.html, about.md, about.tmpl
+	feed is generated by feed, feed.tpl`
+	if err == nil || err.Error() != want {
+		t.Errorf("got load error:\n%v\nwant:\n%s", err, want)
+	}
+}
+
+func TestPrecompressedOutputCollisions(t *testing.T) {
+	td := newTempDir(t)
+	defer td.remove()
+
+	td.writeFile("sitkin/config.json", `{"nohash": ["*"], "precompress": {"formats": ["gzip"], "minSize": 10}}`)
+	td.writeFile("sitkin/default.tmpl", "")
+	td.writeFile("index.tmpl", "")
+	td.writeFile("index.html.gz", "")
+	td.writeFile("app.js", strings.Repeat("x", 20))
+	td.writeFile("app.js.gz", "")
+	td.writeFile("small.css", "a{}") // too small to be compressed
+	td.writeFile("small.css.gz", "")
+
+	_, err := load(td.dir, options{})
+	want := `2 output path collisions:
+	app.js.gz is generated by app.js.gz, gzip of app.js
+	index.html.gz is generated by gzip of index.tmpl, index.html.gz`
+	if err == nil || err.Error() != want {
+		t.Errorf("got load error:\n%v\nwant:\n%s", err, want)
+	}
+}
+
+func TestSlugify(t *testing.T) {
+	for _, tt := range []struct {
+		s    string
+		want string
+	}{
+		{"", ""},
+		{"hello", "hello"},
+		{"Hello, World!", "hello-world"},
+		{"  --a  b--  ", "a-b"},
+		{"Go 1.23 Release", "go-1-23-release"},
+		{"Café au lait", "café-au-lait"},
+	} {
+		if got := slugify(tt.s); got != tt.want {
+			t.Errorf("slugify(%q): got %q; want %q", tt.s, got, tt.want)
+		}
+	}
+}
+
 type tempDir struct {
 	t   *testing.T
 	dir string